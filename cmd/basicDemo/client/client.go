@@ -35,7 +35,11 @@ func main() {
 
 	client := dollop.NewClient("testclient", tlsClient, dollop.DefalutQuicConfig)
 
-	client.Connect("127.0.0.1:19999")
+	err = client.Connect(context.Background(), "127.0.0.1:19999")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
 
 	time.Sleep(time.Second * 1)
 	rawstream, _, err := client.NewRawStream()
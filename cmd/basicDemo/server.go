@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 
 	"github.com/derekwin/dollop-net/dollop"
 	dtls "github.com/derekwin/dollop-net/dollop/tls"
+	"golang.org/x/exp/slog"
 )
 
 const testaddr = "127.0.0.1:19999"
@@ -44,7 +46,8 @@ func main() {
 	rawrouter := RawStreamRouter{}
 
 	server, err := dollop.NewServer("test", dollop.WithTlsConfig(tlsServer),
-		dollop.WithRawRouter(rawrouter))
+		dollop.WithRawRouter(rawrouter),
+		dollop.WithLogger(slog.New(slog.NewTextHandler(os.Stdout))))
 	if err != nil {
 		panic(err)
 	}
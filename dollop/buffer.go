@@ -0,0 +1,51 @@
+package dollop
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minBufClassBits = 9  // 512B
+	maxBufClassBits = 16 // 64KB, 更大的buffer不放回池中
+)
+
+// bufPools pools byte buffers by size class, the cap of a class is a power of two.
+var bufPools [maxBufClassBits - minBufClassBits + 1]sync.Pool
+
+// bufClass returns the pool index for a buffer of size bytes, or -1 if it is too large to be pooled.
+func bufClass(size int) int {
+	if size <= 1<<minBufClassBits {
+		return 0
+	}
+	c := bits.Len(uint(size-1)) - minBufClassBits
+	if c >= len(bufPools) {
+		return -1
+	}
+	return c
+}
+
+// getBuf returns a buffer of len size from the pools, give it back by putBuf once nobody uses it.
+func getBuf(size int) *[]byte {
+	c := bufClass(size)
+	if c < 0 {
+		b := make([]byte, size)
+		return &b
+	}
+	if v := bufPools[c].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size, 1<<(c+minBufClassBits))
+	return &b
+}
+
+// putBuf gives b back to the pools, b must not be used after it.
+func putBuf(b *[]byte) {
+	c := bufClass(cap(*b))
+	if c < 0 || cap(*b) != 1<<(c+minBufClassBits) {
+		return // 不是getBuf分配的
+	}
+	bufPools[c].Put(b)
+}
@@ -0,0 +1,144 @@
+package dollop
+
+import (
+	"errors"
+	"io"
+)
+
+// DefaultChunkSize is the max body len carried by one frame of a chunked msg.
+const DefaultChunkSize int = 64 * 1024
+
+var (
+	// ErrBadChunk be returned if a chunked msg is interrupted by a frame which is not its chunk.
+	ErrBadChunk = errors.New("bad chunk frame")
+	// ErrBodyClosed be returned by writing the body of a chunked msg whose handler has returned.
+	ErrBodyClosed = errors.New("chunked msg body is closed")
+)
+
+// chunkSize returns the body len of one chunk frame which fits the max frame size,
+// at least 1 so WriteMsgFrom always makes progress.
+func (fs *FrameStream) chunkSize() int {
+	size := DefaultChunkSize
+	if fs.maxFrameSize > 0 && size > fs.maxFrameSize-FrameFlagsLen {
+		size = fs.maxFrameSize - FrameFlagsLen
+	}
+	if size < 1 {
+		size = 1 // maxFrameSize容不下任何body时, 帧会被对端以ErrFrameTooLarge拒绝
+	}
+	return size
+}
+
+// WriteMsgFrom writes m as a chunked msg whose body is read from body until io.EOF,
+// so a large body is never held in memory at once. The frames of the msg are written without
+// other frames in between, use a dedicated stream to keep small msgs flowing meanwhile.
+// If reading body fails, the peer reads the error as a *RemoteError from the body.
+func (fs *FrameStream) WriteMsgFrom(m MsgI, body io.Reader) error {
+	stream := fs.getStream()
+	if stream == nil {
+		return ErrFrameStreamNil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	head := NewFrame(data)
+	head.flags = FrameFlagChunk
+	err = fs.writeFrameLocked(stream, head)
+	if err != nil {
+		return err
+	}
+
+	buf := getBuf(fs.chunkSize())
+	defer putBuf(buf)
+	for {
+		n, err := io.ReadFull(body, *buf)
+		switch err {
+		case nil:
+			err = fs.writeFrameLocked(stream, &Frame{len: n, flags: FrameFlagChunk, data: (*buf)[:n]})
+			if err != nil {
+				return err
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			return fs.writeFrameLocked(stream, &Frame{len: n, flags: FrameFlagChunk | FrameFlagFinal, data: (*buf)[:n]})
+		default:
+			// 以错误块结束该msg, 保持帧流对齐
+			msg := []byte(err.Error())
+			fs.writeFrameLocked(stream, &Frame{len: len(msg), flags: FrameFlagChunk | FrameFlagFinal | FrameFlagError, data: msg})
+			return err
+		}
+	}
+}
+
+// ReadMsgBody reads the next msg like ReadMsg, body is nil unless the msg is chunked.
+// The body must be read before the next read of the stream, the unread part is skipped by it.
+func (fs *FrameStream) ReadMsgBody() (m MsgI, body io.Reader, err error) {
+	err = fs.skipBody()
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := fs.readFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.flags&FrameFlagError != 0 {
+		return nil, nil, &RemoteError{Msg: string(f.data)}
+	}
+	if f.flags&FrameFlagChunk != 0 {
+		fs.body = &chunkReader{fs: fs, eof: f.flags&FrameFlagFinal != 0}
+		body = fs.body
+	}
+	m, err = fs.decodeMsg(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, body, nil
+}
+
+// skipBody discards the unread part of the body returned by ReadMsgBody.
+func (fs *FrameStream) skipBody() error {
+	if fs.body == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, fs.body)
+	fs.body = nil
+	return err
+}
+
+// chunkReader reads the body of a chunked msg from the following chunk frames.
+type chunkReader struct {
+	fs   *FrameStream
+	data []byte
+	eof  bool
+	err  error
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.data) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.eof {
+			return 0, io.EOF
+		}
+		f, err := cr.fs.readFrame()
+		if err == nil && f.flags&FrameFlagChunk == 0 {
+			err = ErrBadChunk
+		}
+		if err != nil {
+			cr.err = err
+			return 0, err
+		}
+		cr.eof = f.flags&FrameFlagFinal != 0
+		if f.flags&FrameFlagError != 0 {
+			cr.err = &RemoteError{Msg: string(f.data)}
+			continue
+		}
+		cr.data = f.data
+	}
+	n := copy(p, cr.data)
+	cr.data = cr.data[n:]
+	return n, nil
+}
@@ -3,10 +3,56 @@ package dollop
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/quic-go/quic-go"
+	"golang.org/x/exp/slog"
 )
 
+var (
+	// ErrHandshake be the Reason of ConnectError if the quic/tls handshake failed.
+	ErrHandshake = errors.New("handshake failed")
+	// ErrALPNMismatch be the Reason of ConnectError if client and server have no common NextProtos.
+	ErrALPNMismatch = errors.New("no common application protocol")
+	// ErrControlStream be the Reason of ConnectError if the control stream can not be set up.
+	ErrControlStream = errors.New("control stream setup failed")
+	// ErrClientClosed be returned after Client.Close.
+	ErrClientClosed = errors.New("client closed")
+)
+
+// tls alert no_application_protocol, carried as a quic crypto error 0x100+alert
+const alertNoApplicationProtocol quic.TransportErrorCode = 0x100 + 120
+
+// ConnectError be returned by Client.Connect, errors.Is(err, Reason) reports the kind of failure.
+type ConnectError struct {
+	Addr   string
+	Reason error // ErrHandshake, ErrALPNMismatch or ErrControlStream
+	Err    error // the underlying error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connect %s: %v: %v", e.Addr, e.Reason, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConnectError) Is(target error) bool {
+	return target == e.Reason
+}
+
+func newDialError(addr string, err error) *ConnectError {
+	var te *quic.TransportError
+	if errors.As(err, &te) && te.ErrorCode == alertNoApplicationProtocol {
+		return &ConnectError{Addr: addr, Reason: ErrALPNMismatch, Err: err}
+	}
+	return &ConnectError{Addr: addr, Reason: ErrHandshake, Err: err}
+}
+
 // Client
 type Client struct {
 	// server name
@@ -14,45 +60,308 @@ type Client struct {
 
 	QuicConfig *quic.Config
 	TlsConfig  *tls.Config
-	// logger     *slog.Logger
-	conn *ClientConnection
+	// MaxFrameSize limits the frames of all frame streams on this client
+	MaxFrameSize int
+	logger       *slog.Logger
+	conn         *ClientConnection
+
+	onIncomingRawStream   func(stream RawStreamI)
+	onIncomingFrameStream func(stream FrameStreamI)
+	datagramProtocol      MsgProtocolI
+	compressors           []CompressorI
+	compressMinSize       int
+
+	// 重连, reconnect为nil时不重连
+	reconnect     *Backoff
+	state         ClientState
+	closed        bool
+	closedCh      chan struct{} // Close后关闭, 中断重连等待
+	onStateChange func(state ClientState)
+	// 应用打开的流和订阅, 重连后恢复
+	rawStreams    []*RawStream
+	frameStreams  []*FrameStream
+	subscriptions map[string]FrameStreamI
+	mu            sync.RWMutex
 }
 
 func NewClient(name string, tlsConfig *tls.Config, qConf *quic.Config) *Client {
-	return &Client{Name: name, TlsConfig: tlsConfig, QuicConfig: qConf}
+	return &Client{Name: name, TlsConfig: tlsConfig, QuicConfig: qConf, MaxFrameSize: DefaultMaxFrameSize,
+		logger:        discardLogger,
+		state:         ClientStateClosed, // 尚未连接
+		closedCh:      make(chan struct{}),
+		subscriptions: make(map[string]FrameStreamI)}
+}
+
+// Connect dials addr and sets up the control stream, it returns a *ConnectError on failure.
+func (c *Client) Connect(ctx context.Context, addr string) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	c.setState(ClientStateConnecting)
+
+	cc, err := c.dial(ctx, addr)
+	if err != nil {
+		c.setState(ClientStateClosed)
+		return err
+	}
+	c.setConn(cc)
+	c.setState(ClientStateConnected)
+
+	if c.reconnect != nil {
+		go c.keepAlive(addr, cc)
+	}
+	return nil
 }
 
-func (c *Client) Connect(addr string) {
-	conn, err := quic.DialAddr(addr, c.TlsConfig, c.QuicConfig)
+// dial establishes a new ClientConnection with its control stream.
+func (c *Client) dial(ctx context.Context, addr string) (*ClientConnection, error) {
+	qConf := c.QuicConfig
+	if c.datagramProtocol != nil && (qConf == nil || !qConf.EnableDatagrams) {
+		if qConf == nil {
+			qConf = &quic.Config{}
+		} else {
+			qConf = qConf.Clone()
+		}
+		qConf.EnableDatagrams = true
+	}
+
+	conn, err := quic.DialAddrContext(ctx, addr, c.TlsConfig, qConf)
+	if err != nil {
+		return nil, newDialError(addr, err)
+	}
+
+	cc := NewClientConnection(context.Background(), conn)
+	cc.SetMaxFrameSize(c.MaxFrameSize)
+	cc.SetLogger(c.logger)
+	cc.SetCompression(c.compressMinSize, c.compressors...)
+	cc.onIncomingRawStream = c.onIncomingRawStream
+	cc.onIncomingFrameStream = c.onIncomingFrameStream
+
+	err = c.setupControlStream(ctx, cc)
 	if err != nil {
-		panic(err)
+		conn.CloseWithError(ClientConnectionCloseCode, err.Error())
+		return nil, &ConnectError{Addr: addr, Reason: ErrControlStream, Err: err}
 	}
 
-	c.conn = NewClientConnection(context.Background(), conn)
+	go cc.controlStreamLoop()
+	return cc, nil
+}
 
-	stream, err := conn.OpenStreamSync(context.Background())
+func (c *Client) setupControlStream(ctx context.Context, cc *ClientConnection) error {
+	stream, err := cc.qconn.OpenStreamSync(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	controlStream := NewFrameStream(stream)
+	controlStream := cc.newFrameStream(stream)
 	controlStream.BindMsgProtocol(controlMsgProtocol)
 
-	c.conn.setControlStream(controlStream)
+	cc.setControlStream(controlStream)
+
+	// ctx结束时中断等待Hello
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	// 发送Hello使server可以接收到控制流, 并等待server的Hello
+	err = controlStream.WriteMsg(NewHelloMsg([]byte{}))
+	if err != nil {
+		return err
+	}
+	m, err := controlStream.ReadMsg()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if _, ok := m.(*HelloMsg); !ok {
+		return fmt.Errorf("control stream not receive Hello")
+	}
+	return nil
+}
+
+// Close stops reconnecting and closes the conn with ClientConnectionCloseCode.
+func (c *Client) Close() error {
+	c.markClosed()
+
+	cc := c.getConn()
+	if cc == nil {
+		return nil
+	}
+	return cc.Close()
+}
+
+func (c *Client) getConn() *ClientConnection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+func (c *Client) setConn(cc *ClientConnection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = cc
+}
+
+// SetLogger sets the structured logger of the client and its conns, the client is silent by default.
+// Call it before Connect.
+func (c *Client) SetLogger(l *slog.Logger) {
+	c.logger = l.With("client", c.Name)
+}
+
+// EnableReconnect makes the client reconnect with backoff after the conn drops or the server sends GoAway,
+// the raw/frame/rpc streams opened by the client and its subscriptions are restored on the new conn.
+// The zero or invalid fields of backoff fall back to DefaultBackoff. Call it before Connect.
+func (c *Client) EnableReconnect(backoff Backoff) {
+	backoff = backoff.withDefaults()
+	c.reconnect = &backoff
+}
+
+// OnStateChange sets the hook called on every state transition, set it before Connect.
+func (c *Client) OnStateChange(h func(state ClientState)) {
+	c.onStateChange = h
+}
+
+func (c *Client) State() ClientState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+func (c *Client) setState(state ClientState) {
+	c.mu.Lock()
+	changed := c.state != state
+	c.state = state
+	c.mu.Unlock()
+
+	if changed && c.onStateChange != nil {
+		c.onStateChange(state)
+	}
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+func (c *Client) markClosed() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.closedCh)
+	}
+	c.mu.Unlock()
+	c.setState(ClientStateClosed)
+}
+
+// EnableDatagrams enables quic datagrams parsed by mp, call it before Connect.
+func (c *Client) EnableDatagrams(mp MsgProtocolI) {
+	c.datagramProtocol = mp
+}
+
+// EnableCompression asks for cs, in preference order, for every frame stream opened by NewFrameStream,
+// the server chooses one of them it accepts by WithCompression or none. Frames whose data is at least minSize
+// are compressed, <=0 for DefaultCompressMinSize. Call it before Connect, the streams opened by the server
+// are not compressed.
+func (c *Client) EnableCompression(minSize int, cs ...CompressorI) {
+	c.compressMinSize = minSize
+	c.compressors = cs
+}
+
+// GetDatagramChannel returns the datagram channel, ErrDatagramNotSupported if the server did not enable it.
+func (c *Client) GetDatagramChannel() (DatagramChannelI, error) {
+	channel, err := c.getConn().GetDatagramChannel()
+	if err != nil {
+		return nil, err
+	}
+	if c.datagramProtocol != nil {
+		channel.BindMsgProtocol(c.datagramProtocol)
+	}
+	return channel, nil
+}
+
+// OnIncomingRawStream sets the hook called when the server opens a raw stream toward this client,
+// set it before Connect.
+func (c *Client) OnIncomingRawStream(h func(stream RawStreamI)) {
+	c.onIncomingRawStream = h
+}
+
+// OnIncomingFrameStream sets the hook called when the server opens a frame stream toward this client,
+// set it before Connect.
+func (c *Client) OnIncomingFrameStream(h func(stream FrameStreamI)) {
+	c.onIncomingFrameStream = h
 }
 
 func (c *Client) NewRawStream() (RawStreamI, StreamID, error) {
-	return c.conn.OpenNewRawStream()
+	stream, id, err := c.getConn().requestRawStream()
+	if err != nil {
+		return nil, 0, err
+	}
+	c.mu.Lock()
+	c.rawStreams = append(c.rawStreams, stream)
+	c.mu.Unlock()
+	return stream, id, nil
 }
 
 func (c *Client) GetRawStream(id StreamID) (RawStreamI, error) {
-	return c.conn.GetRawStream(id)
+	return c.getConn().GetRawStream(id)
 }
 
-func (c *Client) NewFrameStream() (FrameStreamI, StreamID, error) {
-	return c.conn.OpenNewFrameStream()
+// NewFrameStream opens a frame stream bound to one of mps, the versions of one protocol in preference order,
+// the server chooses the first version it has registered. The default protocol is bound if mps is empty.
+// An error wrapping ErrStreamRejected is returned if the server has none of them.
+func (c *Client) NewFrameStream(mps ...MsgProtocolI) (FrameStreamI, StreamID, error) {
+	stream, id, err := c.getConn().requestFrameStream(mps...)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.mu.Lock()
+	c.frameStreams = append(c.frameStreams, stream)
+	c.mu.Unlock()
+	return stream, id, nil
 }
 
 func (c *Client) GetFrameStream(id StreamID) (FrameStreamI, error) {
-	return c.conn.GetFrameStream(id)
+	return c.getConn().GetFrameStream(id)
+}
+
+// NewRPCStream opens a new frame stream bound to one of mps like NewFrameStream, and wraps it for concurrent calls.
+// With EnableReconnect the stream is restored after a reconnect, the calls pending on the dropped conn fail.
+func (c *Client) NewRPCStream(mps ...MsgProtocolI) (*RPCStream, StreamID, error) {
+	stream, id, err := c.NewFrameStream(mps...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.reconnect == nil {
+		return NewRPCStream(stream), id, nil
+	}
+	return newRPCStream(stream, c.closedCh), id, nil
+}
+
+// Subscribe asks the server to deliver the msgs published to topic on stream,
+// read them by stream.ReadMsg.
+func (c *Client) Subscribe(topic string, stream FrameStreamI) error {
+	err := c.getConn().Subscribe(topic, stream.StreamID())
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.subscriptions[topic] = stream
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	delete(c.subscriptions, topic)
+	c.mu.Unlock()
+	return c.getConn().Unsubscribe(topic)
 }
@@ -0,0 +1,65 @@
+package dollop
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// connectWith connects a client of tlsConf to addr and returns the error of Connect.
+func connectWith(t *testing.T, addr string, tlsConf *tls.Config) error {
+	c := NewClient("test", tlsConf, DefalutQuicConfig)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return c.Connect(ctx, addr)
+}
+
+func TestConnectALPNMismatch(t *testing.T) {
+	_, addr := startTestServer(t)
+	_, ct := testTLS(t)
+	tlsConf := ct.Clone()
+	tlsConf.NextProtos = []string{"other"}
+
+	err := connectWith(t, addr, tlsConf)
+	if !errors.Is(err, ErrALPNMismatch) {
+		t.Fatalf("Connect = %v, want ErrALPNMismatch", err)
+	}
+	var ce *ConnectError
+	if !errors.As(err, &ce) || ce.Addr != addr || ce.Err == nil {
+		t.Fatalf("Connect = %#v, want a *ConnectError of %s with the quic error", err, addr)
+	}
+}
+
+func TestConnectHandshakeFailed(t *testing.T) {
+	_, addr := startTestServer(t)
+	_, ct := testTLS(t)
+	tlsConf := ct.Clone()
+	tlsConf.InsecureSkipVerify = false // 自签名证书校验失败
+	tlsConf.ServerName = "localhost"
+
+	err := connectWith(t, addr, tlsConf)
+	if !errors.Is(err, ErrHandshake) || errors.Is(err, ErrALPNMismatch) {
+		t.Fatalf("Connect = %v, want ErrHandshake", err)
+	}
+}
+
+func TestClientCloseCode(t *testing.T) {
+	conns := make(chan ConnectionIS, 1)
+	_, addr := startTestServer(t, WithOnConnect(func(conn ConnectionIS) { conns <- conn }))
+	c := dialTestClient(t, addr, nil)
+	sc := recvOrFail(t, conns).(*ServerConnection)
+
+	c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := sc.qconn.AcceptUniStream(ctx)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || !appErr.Remote || appErr.ErrorCode != ClientConnectionCloseCode {
+		t.Fatalf("server saw %v, want the client close with ClientConnectionCloseCode", err)
+	}
+}
@@ -0,0 +1,291 @@
+package dollop
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrTypeNotRegistered be returned if a value of a type without tag is written by a CodecProtocol.
+	ErrTypeNotRegistered = errors.New("type is not registered")
+	// ErrTagRegistered be returned if a tag or a type is registered twice, or the tag is reserved.
+	ErrTagRegistered = errors.New("tag is registered or reserved")
+)
+
+// Codec marshals the values of the msgs of a CodecProtocol.
+// JSONCodec and GobCodec are shipped, implement it to plug in e.g. msgpack or CBOR.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes every msg by a new gob.Encoder, so each msg carries its type description.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// CodecMsg is a msg of a CodecProtocol, its data is the value marshalled by the codec.
+type CodecMsg struct {
+	tag   MsgType // CodecProtocol的TagEncoding对应的tag类型
+	data  []byte
+	value interface{} // *T, 由PaserMsg解码或由NewMsg传入
+	err   error       // 解码错误
+}
+
+func (cm CodecMsg) Type() MsgType {
+	return cm.tag
+}
+
+func (cm CodecMsg) Encode() []byte {
+	return BuildMsg(cm.tag, cm.data)
+}
+
+func (cm CodecMsg) GetData() []byte {
+	return cm.data
+}
+
+// Value returns the decoded value, a pointer to the type registered for the tag of the msg.
+func (cm CodecMsg) Value() (interface{}, error) {
+	return cm.value, cm.err
+}
+
+// MsgValue returns the value of m, a *CodecMsg, as a *T.
+func MsgValue[T any](m MsgI) (*T, error) {
+	cm, ok := m.(*CodecMsg)
+	if !ok {
+		return nil, fmt.Errorf("msg %T is not a *CodecMsg", m)
+	}
+	if cm.err != nil {
+		return nil, cm.err
+	}
+	v, ok := cm.value.(*T)
+	if !ok {
+		return nil, fmt.Errorf("msg value is %T, not %T", cm.value, v)
+	}
+	return v, nil
+}
+
+// CodecProtocol is a msg protocol of Go types registered against tags, whose values are marshalled by a Codec.
+// Its tags are encoded by the TagEncoding given at creation, a tag of any integer or string type is
+// accepted at registration if it fits the encoding, e.g. Register(300, ...) for TagUint16
+// or Register("player.move", ...) for TagString.
+type CodecProtocol struct {
+	MiddlewareSet // 协议级和msg级的中间件
+	name          string
+	version       string
+	codec         Codec
+	encoding      TagEncoding
+	mu            sync.RWMutex
+	types         map[MsgType]reflect.Type
+	tags          map[reflect.Type]MsgType
+	routers       map[MsgType]FrameRouterI
+	fallback      FrameRouterI
+}
+
+// NewCodecProtocol creates a CodecProtocol of uint8 tags.
+func NewCodecProtocol(name, version string, codec Codec) *CodecProtocol {
+	cp, _ := NewCodecProtocolWithTags(name, version, codec, TagUint8)
+	return cp
+}
+
+// NewCodecProtocolWithTags creates a CodecProtocol whose tags are encoded by enc.
+func NewCodecProtocolWithTags(name, version string, codec Codec, enc TagEncoding) (*CodecProtocol, error) {
+	if enc > TagString {
+		return nil, fmt.Errorf("%w: unknown encoding %s", ErrBadMsgTag, enc)
+	}
+	return &CodecProtocol{
+		name:     name,
+		version:  version,
+		codec:    codec,
+		encoding: enc,
+		types:    make(map[MsgType]reflect.Type),
+		tags:     make(map[reflect.Type]MsgType),
+		routers:  make(map[MsgType]FrameRouterI),
+	}, nil
+}
+
+func (cp *CodecProtocol) Name() string {
+	return cp.name
+}
+
+func (cp *CodecProtocol) Version() string {
+	return cp.version
+}
+
+func (cp *CodecProtocol) Codec() Codec {
+	return cp.codec
+}
+
+func (cp *CodecProtocol) TagEncoding() TagEncoding {
+	return cp.encoding
+}
+
+// tag validates tag and converts it into the tag type of the encoding, rejecting the reserved NotFound tag.
+func (cp *CodecProtocol) tag(tag MsgType) (MsgType, error) {
+	t, err := cp.encoding.Tag(tag)
+	if err != nil {
+		return nil, err
+	}
+	if t == cp.encoding.NotFoundTag() {
+		return nil, fmt.Errorf("%w: %v", ErrTagRegistered, t)
+	}
+	return t, nil
+}
+
+// Register binds the type of v, a struct or a pointer to it, to tag.
+func (cp *CodecProtocol) Register(tag MsgType, v interface{}) error {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return fmt.Errorf("%w: nil value for tag %v", ErrTypeNotRegistered, tag)
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	tag, err := cp.tag(tag)
+	if err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if _, ok := cp.types[tag]; ok {
+		return fmt.Errorf("%w: %v", ErrTagRegistered, tag)
+	}
+	if _, ok := cp.tags[t]; ok {
+		return fmt.Errorf("%w: type %s", ErrTagRegistered, t)
+	}
+	cp.types[tag] = t
+	cp.tags[t] = tag
+	return nil
+}
+
+func (cp *CodecProtocol) typeOf(tag MsgType) reflect.Type {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	return cp.types[tag]
+}
+
+func (cp *CodecProtocol) tagOf(t reflect.Type) (MsgType, bool) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	tag, ok := cp.tags[t]
+	return tag, ok
+}
+
+// RegisterType binds T to tag, the same as cp.Register(tag, new(T)).
+func RegisterType[T any](cp *CodecProtocol, tag MsgType) error {
+	return cp.Register(tag, new(T))
+}
+
+// AddM2R routes the msgs of tag, validated like Register, to router.
+func (cp *CodecProtocol) AddM2R(tag MsgType, router FrameRouterI) error {
+	tag, err := cp.tag(tag)
+	if err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.routers[tag] = router
+	return nil
+}
+
+func (cp *CodecProtocol) GetRouter(tag MsgType) (FrameRouterI, error) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	r := cp.routers[tag]
+	if r == nil {
+		return nil, ErrRouterNotFound
+	}
+	return r, nil
+}
+
+// UseFor adds mws for the msgs of tag only, tag is converted like Register.
+func (cp *CodecProtocol) UseFor(tag MsgType, mws ...FrameMiddleware) {
+	if t, err := cp.encoding.Tag(tag); err == nil {
+		tag = t
+	}
+	cp.MiddlewareSet.UseFor(tag, mws...)
+}
+
+// SetFallbackRouter sets the router of the msgs without their own router.
+func (cp *CodecProtocol) SetFallbackRouter(r FrameRouterI) {
+	cp.fallback = r
+}
+
+func (cp *CodecProtocol) FallbackRouter() FrameRouterI {
+	return cp.fallback
+}
+
+// NotFoundMsg replies the tag of m under the NotFound tag of the encoding.
+func (cp *CodecProtocol) NotFoundMsg(m MsgI) MsgI {
+	data, _ := cp.encoding.AppendTag(nil, m.Type())
+	return &NotFoundMsg{tag: cp.encoding.NotFoundTag(), data: data}
+}
+
+// NewMsg marshals v, whose type must be registered, into a msg.
+func (cp *CodecProtocol) NewMsg(v interface{}) (*CodecMsg, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	tag, ok := cp.tagOf(t)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrTypeNotRegistered, t)
+	}
+	data, err := cp.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &CodecMsg{tag: tag, data: data, value: v}, nil
+}
+
+// PaserMsg decodes the value of a registered tag, a decoding error is returned by CodecMsg.Value.
+func (cp *CodecProtocol) PaserMsg(f *Frame) MsgI {
+	tag, n, err := cp.encoding.ReadTag(f.data)
+	if err != nil {
+		return nil
+	}
+	data := f.data[n:]
+	if tag == cp.encoding.NotFoundTag() {
+		return &NotFoundMsg{tag: tag, data: data}
+	}
+
+	t := cp.typeOf(tag)
+	if t == nil {
+		return NewUnknownMsg(tag, f.data)
+	}
+	v := reflect.New(t).Interface()
+	err = cp.codec.Unmarshal(data, v)
+	return &CodecMsg{tag: tag, data: data, value: v, err: err}
+}
@@ -0,0 +1,158 @@
+package dollop
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type codecPoint struct {
+	X, Y  int
+	Label string
+	Tags  []string
+}
+
+// prefixCodec is a custom Codec, it marshals json behind a prefix and rejects data without it.
+type prefixCodec struct {
+	prefix []byte
+}
+
+func (pc prefixCodec) Name() string {
+	return "prefix"
+}
+
+func (pc prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, pc.prefix...), data...), nil
+}
+
+func (pc prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, pc.prefix) {
+		return errors.New("missing prefix")
+	}
+	return json.Unmarshal(data[len(pc.prefix):], v)
+}
+
+// codecRoundTrip writes v by cp on a frame stream in memory, and returns the msg read back.
+func codecRoundTrip(t *testing.T, cp *CodecProtocol, v interface{}) MsgI {
+	t.Helper()
+	fs := newPipeFrameStream()
+	fs.BindMsgProtocol(cp)
+	m, err := cp.NewMsg(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := &codecPoint{X: 1, Y: -2, Label: "p", Tags: []string{"a", "b"}}
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, prefixCodec{prefix: []byte("v1:")}} {
+		cp := NewCodecProtocol("points", "v1", codec)
+		if err := RegisterType[codecPoint](cp, 3); err != nil {
+			t.Fatal(err)
+		}
+		m := codecRoundTrip(t, cp, want)
+		if m.Type() != BaseMsgType(3) {
+			t.Fatalf("%s: msg tag = %v, want 3", codec.Name(), m.Type())
+		}
+		got, err := MsgValue[codecPoint](m)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: value = %+v, %v, want %+v", codec.Name(), got, err, want)
+		}
+	}
+}
+
+func TestCustomCodecPlugged(t *testing.T) {
+	codec := prefixCodec{prefix: []byte("v1:")}
+	cp := NewCodecProtocol("points", "v1", codec)
+	if err := RegisterType[codecPoint](cp, 3); err != nil {
+		t.Fatal(err)
+	}
+	m, err := cp.NewMsg(&codecPoint{X: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(m.GetData(), codec.prefix) {
+		t.Fatalf("msg data %q is not marshalled by the custom codec", m.GetData())
+	}
+	if cp.Codec().Name() != "prefix" {
+		t.Fatalf("Codec().Name() = %q", cp.Codec().Name())
+	}
+
+	// 解码错误由Value返回, 而不是丢弃msg
+	bad := cp.PaserMsg(NewFrame(BuildMsg(BaseMsgType(3), []byte(`{"X":1}`))))
+	if _, err := MsgValue[codecPoint](bad); err == nil || err.Error() != "missing prefix" {
+		t.Fatalf("value of data without prefix = %v, want the codec error", err)
+	}
+	if _, err := cp.NewMsg(&struct{}{}); !errors.Is(err, ErrTypeNotRegistered) {
+		t.Fatalf("NewMsg of an unregistered type = %v, want ErrTypeNotRegistered", err)
+	}
+}
+
+// valueEchoRouter replies the decoded value of a CodecMsg, marshalled again by cp.
+type valueEchoRouter struct {
+	BaseFrameRouter
+	cp *CodecProtocol
+}
+
+func (vr valueEchoRouter) Handler(req FrameRequestI) error {
+	m, err := req.GetMsg()
+	if err != nil {
+		return err
+	}
+	v, err := m.(*CodecMsg).Value()
+	if err != nil {
+		return err
+	}
+	out, err := vr.cp.NewMsg(v)
+	if err != nil {
+		return err
+	}
+	return req.Reply(out)
+}
+
+func TestCustomCodecLoopback(t *testing.T) {
+	cp := NewCodecProtocol("points", "v1", prefixCodec{prefix: []byte("v1:")})
+	if err := RegisterType[codecPoint](cp, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.AddM2R(3, valueEchoRouter{cp: cp}); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startTestServer(t, WithMsgProtocol(cp))
+	c := dialTestClient(t, addr, nil)
+	rs, _, err := c.NewRPCStream(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &codecPoint{X: 5, Label: "remote"}
+	m, err := cp.NewMsg(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	reply, err := rs.Call(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := MsgValue[codecPoint](reply); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("reply value = %+v, %v, want %+v", got, err, want)
+	}
+}
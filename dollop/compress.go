@@ -0,0 +1,209 @@
+package dollop
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// DefaultCompressMinSize is the min data len of a frame compressed on a compressed frame stream,
+// smaller frames, e.g. game inputs, are sent as they are.
+const DefaultCompressMinSize int = 256
+
+// ErrBadCompressedFrame be returned if a compressed frame arrives on a stream without compressor or can not be decompressed.
+var ErrBadCompressedFrame = errors.New("bad compressed frame")
+
+// CompressorI compresses the frame data of a frame stream, it is negotiated by Name when the stream is opened.
+// DeflateCompressor and SnappyCompressor are shipped, see DefaultCompressors, implement it to plug in e.g. zstd.
+type CompressorI interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress fails with ErrFrameTooLarge if the data would be longer than maxSize, <=0 means unlimited.
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+// DeflateCompressor compresses by compress/flate, its writers and readers are pooled.
+type DeflateCompressor struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewDeflateCompressor creates a DeflateCompressor of level, e.g. flate.BestSpeed.
+func NewDeflateCompressor(level int) (*DeflateCompressor, error) {
+	_, err := flate.NewWriter(io.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	return &DeflateCompressor{level: level}, nil
+}
+
+func (dc *DeflateCompressor) Name() string {
+	return "deflate"
+}
+
+func (dc *DeflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(data) / 2)
+	w, _ := dc.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, dc.level) // level已由NewDeflateCompressor校验
+	} else {
+		w.Reset(&buf)
+	}
+	defer dc.writers.Put(w)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+func (dc *DeflateCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, _ := dc.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(data))
+	} else {
+		r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	}
+	defer dc.readers.Put(r)
+	return readLimited(r, maxSize)
+}
+
+// SnappyCompressor compresses by the snappy block format, faster than deflate at a lower ratio.
+type SnappyCompressor struct{}
+
+func (SnappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (SnappyCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && n > maxSize {
+		return nil, fmt.Errorf("%w: decompressed %d > %d", ErrFrameTooLarge, n, maxSize)
+	}
+	return snappy.Decode(nil, data)
+}
+
+var defaultDeflate, _ = NewDeflateCompressor(flate.DefaultCompression)
+
+// DefaultCompressors returns the shipped compressors in preference order, snappy then deflate,
+// e.g. for WithCompression and Client.EnableCompression.
+func DefaultCompressors() []CompressorI {
+	return []CompressorI{SnappyCompressor{}, defaultDeflate}
+}
+
+// readLimited reads r until io.EOF, ErrFrameTooLarge is returned once more than maxSize bytes are read.
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w: decompressed > %d", ErrFrameTooLarge, maxSize)
+	}
+	return data, nil
+}
+
+// negotiateCompressor returns the first of names in cs, nil if none.
+func negotiateCompressor(names []string, cs []CompressorI) CompressorI {
+	for _, name := range names {
+		for _, c := range cs {
+			if c.Name() == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// compressorOf returns the one of cs named name, nil if name is empty.
+func compressorOf(name string, cs []CompressorI) (CompressorI, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if c := negotiateCompressor([]string{name}, cs); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: peer chose compressor %s", ErrBadCompressedFrame, name)
+}
+
+// appendCompressors appends the compressor names to the data of a stream request or ack
+// after a zero len byte: | protocol | 0 | nameLen [1] | name | ... |.
+func appendCompressors(data []byte, names ...string) ([]byte, error) {
+	if len(names) == 0 {
+		return data, nil
+	}
+	data = append(data, 0)
+	for _, name := range names {
+		if !validProtocolString(name) {
+			return nil, fmt.Errorf("%w: compressor %q", ErrBadProtocolName, name)
+		}
+		data = append(data, byte(len(name)))
+		data = append(data, name...)
+	}
+	return data, nil
+}
+
+// splitCompressors splits the data of appendCompressors into the protocol part and the compressor names.
+func splitCompressors(data []byte) (protocol []byte, names []string, err error) {
+	for i := 0; i < len(data); i += 1 + int(data[i]) {
+		if data[i] != 0 {
+			continue
+		}
+		name, rest, err := decodeProtocol(data[i+1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return data[:i], append([]string{name}, rest...), nil
+	}
+	return data, nil, nil
+}
+
+// compressFrame returns f with its data compressed by c, or f itself if that does not save any byte.
+func compressFrame(f *Frame, c CompressorI) *Frame {
+	data, err := c.Compress(f.data)
+	if err != nil || len(data) >= len(f.data) {
+		return f
+	}
+	cf := *f
+	cf.flags |= FrameFlagCompressed
+	cf.data = data
+	cf.len = len(data)
+	cf.buf = nil
+	return &cf
+}
+
+// decompressFrame replaces the data of a compressed f with the decompressed one, releasing its pooled buffer.
+func decompressFrame(f *Frame, c CompressorI, maxSize int) error {
+	if c == nil {
+		return fmt.Errorf("%w: stream is not compressed", ErrBadCompressedFrame)
+	}
+	data, err := c.Decompress(f.data, maxSize)
+	if err != nil {
+		if errors.Is(err, ErrFrameTooLarge) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrBadCompressedFrame, err)
+	}
+	f.Release()
+	f.flags &^= FrameFlagCompressed
+	f.data = data
+	f.len = len(data)
+	return nil
+}
@@ -0,0 +1,142 @@
+package dollop
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	text := bytes.Repeat([]byte("chat message hello world "), 400)
+	noise := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(noise)
+	for _, c := range DefaultCompressors() {
+		for _, data := range [][]byte{text, noise, {}} {
+			z, err := c.Compress(data)
+			if err != nil {
+				t.Fatalf("%s: %v", c.Name(), err)
+			}
+			got, err := c.Decompress(z, 0)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: round trip of %d bytes = %d bytes, %v", c.Name(), len(data), len(got), err)
+			}
+		}
+		z, _ := c.Compress(text)
+		if len(z) >= len(text)/4 {
+			t.Errorf("%s: compressed %d bytes to %d", c.Name(), len(text), len(z))
+		}
+		if _, err := c.Decompress(z, len(text)-1); !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("%s: decompress over maxSize err = %v", c.Name(), err)
+		}
+		if _, err := c.Decompress([]byte("not compressed at all"), 0); err == nil {
+			t.Errorf("%s: decompressed garbage", c.Name())
+		}
+	}
+}
+
+func TestCompressFrame(t *testing.T) {
+	c := SnappyCompressor{}
+	data := bytes.Repeat([]byte("a"), 1000)
+	f := NewFrame(data)
+	cf := compressFrame(f, c)
+	if cf.flags&FrameFlagCompressed == 0 || len(cf.data) >= len(data) {
+		t.Fatalf("frame not compressed: %d bytes, flags %b", len(cf.data), cf.flags)
+	}
+	if !bytes.Equal(f.data, data) || f.flags != 0 {
+		t.Error("compressFrame modified the frame")
+	}
+	if err := decompressFrame(cf, c, 0); err != nil || !bytes.Equal(cf.data, data) || cf.flags&FrameFlagCompressed != 0 {
+		t.Errorf("decompressFrame = %d bytes, flags %b, %v", len(cf.data), cf.flags, err)
+	}
+
+	if small := NewFrame([]byte{1, 2}); compressFrame(small, c) != small {
+		t.Error("a frame compressed larger was not sent as it is")
+	}
+	if err := decompressFrame(compressFrame(NewFrame(data), c), nil, 0); !errors.Is(err, ErrBadCompressedFrame) {
+		t.Errorf("compressed frame on a stream without compressor err = %v", err)
+	}
+}
+
+func TestCompressorsInStreamMsgs(t *testing.T) {
+	req, err := BuildRequestFrameStreamMsg("game", "v2", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := appendCompressors(req.data, "snappy", "deflate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = NewRequestFrameStreamMsg(data)
+	name, versions, err := req.Protocol()
+	names, err2 := req.Compressors()
+	if err != nil || err2 != nil || name != "game" || len(versions) != 2 || len(names) != 2 || names[0] != "snappy" {
+		t.Errorf("request = %s %v %v, %v %v", name, versions, names, err, err2)
+	}
+
+	// 默认协议的请求只有压缩部分
+	data, _ = appendCompressors(nil, "deflate")
+	name, _, err = NewRequestFrameStreamMsg(data).Protocol()
+	names, _ = NewRequestFrameStreamMsg(data).Compressors()
+	if err != nil || name != "" || len(names) != 1 {
+		t.Errorf("default protocol request = %q %v %v", name, names, err)
+	}
+
+	data, _ = encodeProtocol("game", "v1")
+	data, _ = appendCompressors(data, "snappy")
+	ack := NewAckStreamMsg(data)
+	name, version, err := ack.Protocol()
+	c, err2 := ack.Compressor()
+	if err != nil || err2 != nil || name != "game" || version != "v1" || c != "snappy" {
+		t.Errorf("ack = %s %s %s, %v %v", name, version, c, err, err2)
+	}
+	if negotiateCompressor([]string{"zstd", "deflate"}, DefaultCompressors()).Name() != "deflate" {
+		t.Error("negotiation did not pick the first accepted compressor")
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	deflate, _ := NewDeflateCompressor(1)
+	tests := []struct {
+		name   string
+		server []CompressorI
+		client []CompressorI
+		want   string
+	}{
+		{"client preference", DefaultCompressors(), []CompressorI{deflate, SnappyCompressor{}}, "deflate"},
+		{"server subset", []CompressorI{deflate}, DefaultCompressors(), "deflate"},
+		{"snappy", DefaultCompressors(), []CompressorI{SnappyCompressor{}}, "snappy"},
+		{"server none", nil, DefaultCompressors(), "none"},
+		{"client none", DefaultCompressors(), nil, "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mp := newEchoProtocol(echoRouter{reportCompressor: true})
+			_, addr := startTestServer(t, WithMsgProtocol(mp), WithCompression(64, tt.server...))
+			c := dialTestClient(t, addr, func(c *Client) { c.EnableCompression(64, tt.client...) })
+			fs, _, err := c.NewFrameStream(mp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := "none"
+			if fs.Compressor() != nil {
+				client = fs.Compressor().Name()
+			}
+			if client != tt.want {
+				t.Errorf("client compressor = %s, want %s", client, tt.want)
+			}
+			for _, data := range [][]byte{[]byte("tiny"), bytes.Repeat([]byte("asset "), 20000)} {
+				if err := fs.WriteMsg(NewBaseMsg(data)); err != nil {
+					t.Fatal(err)
+				}
+				m, err := fs.ReadMsg()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := append([]byte(tt.want+":"), data...); !bytes.Equal(m.GetData(), want) {
+					t.Errorf("echo of %d bytes = %d bytes %.20q", len(data), len(m.GetData()), m.GetData())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package dollop
+
+import (
+	"fmt"
+	"sync"
+)
+
+type ConnManagerI interface {
+	Add(conn ConnectionIS)
+	Remove(conn ConnectionIS)
+	Get(id ConnID) (ConnectionIS, error)
+	Len() int
+	// Range calls f for each live conn, stops if f returns false
+	Range(f func(conn ConnectionIS) bool)
+}
+
+// ConnManager is the server side registry of live connections.
+type ConnManager struct {
+	conns map[ConnID]ConnectionIS
+	mu    sync.RWMutex
+}
+
+func NewConnManager() *ConnManager {
+	return &ConnManager{conns: make(map[ConnID]ConnectionIS)}
+}
+
+func (cm *ConnManager) Add(conn ConnectionIS) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.conns[conn.ID()] = conn
+}
+
+func (cm *ConnManager) Remove(conn ConnectionIS) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.conns, conn.ID())
+}
+
+func (cm *ConnManager) Get(id ConnID) (ConnectionIS, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	conn, ok := cm.conns[id]
+	if !ok {
+		return nil, fmt.Errorf("err get conn %d", id)
+	}
+	return conn, nil
+}
+
+func (cm *ConnManager) Len() int {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return len(cm.conns)
+}
+
+func (cm *ConnManager) Range(f func(conn ConnectionIS) bool) {
+	// 先复制一份, 避免f中调用Add/Remove造成死锁
+	cm.mu.RLock()
+	conns := make([]ConnectionIS, 0, len(cm.conns))
+	for _, conn := range cm.conns {
+		conns = append(conns, conn)
+	}
+	cm.mu.RUnlock()
+
+	for _, conn := range conns {
+		if !f(conn) {
+			return
+		}
+	}
+}
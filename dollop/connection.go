@@ -1,19 +1,49 @@
 package dollop
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/quic-go/quic-go"
+	"golang.org/x/exp/slog"
 )
 
 type StreamID int64
 
-const ServerConnectionCloseCode quic.ApplicationErrorCode = 701
+// ConnID identifies a connection inside this process.
+type ConnID uint64
+
+var connIDGen uint64
+
+func nextConnID() ConnID {
+	return ConnID(atomic.AddUint64(&connIDGen, 1))
+}
+
+const (
+	ServerConnectionCloseCode quic.ApplicationErrorCode = 701
+	// ServerShutdownCloseCode is used when the server closes the conn during Shutdown.
+	ServerShutdownCloseCode quic.ApplicationErrorCode = 702
+	// FrameErrorCloseCode is used when a frame stream can not be decoded any more,
+	// e.g. ErrFrameTooLarge or ErrShortFrame.
+	FrameErrorCloseCode quic.ApplicationErrorCode = 703
+	// SlowConsumerCloseCode is used when a subscriber can not keep up with its topic.
+	SlowConsumerCloseCode quic.ApplicationErrorCode = 704
+	// ClientConnectionCloseCode is used when the client side closes the conn.
+	ClientConnectionCloseCode quic.ApplicationErrorCode = 705
+)
 
 type ConnectionI interface {
+	ID() ConnID
+	RemoteAddr() net.Addr
 	GetQConn() (quic.Connection, error)
 	GetRawStream(id StreamID) (RawStreamI, error)          // *RawStream
 	GetFrameStream(id StreamID) (FrameStreamI, error)      // *FrameStream
@@ -22,23 +52,90 @@ type ConnectionI interface {
 	addFrameStream(id StreamID, stream FrameStreamI) error // *FrameStream
 	deleteRawStream(id StreamID) error
 	deleteFrameStream(id StreamID) error
+	Logger() *slog.Logger // 带有连接ID和对端地址的logger
+	Tracer() TracerI
 	OpenStreamSync() (quic.Stream, error)
+	GetDatagramChannel() (DatagramChannelI, error) // *DatagramChannel
+	newFrameStream(s quic.Stream) *FrameStream     // 按连接配置创建帧流
+	compressStream(fs *FrameStream, c CompressorI) // 按连接配置的最小长度压缩帧流
+	closeWithError(code quic.ApplicationErrorCode, msg string) error
+	isClosed() bool
+	// 连接属性, 用于绑定业务session等
+	SetProperty(key string, value interface{})
+	GetProperty(key string) (interface{}, error)
+	RemoveProperty(key string)
 	Close() error
 }
 
 // Connection 初始启动时候，建立一条controlStream，类型是FrameStream，用于管理后续流的建立和维护。提供两种流，不进行分包的流quic.stream, 分帧的流 FrameStream
 type Connection struct {
+	id            ConnID
 	ctx           context.Context
 	qconn         quic.Connection
-	controlStream FrameStreamI // *ControlStream
-	rawStreams    sync.Map     // 无分包的流 RawStreamI *RawStream
-	frameStreams  sync.Map     // 帧流 FrameStreamI *FrameStream
-	group         sync.WaitGroup
+	controlStream FrameStreamI   // *ControlStream
+	csMu          sync.RWMutex   // 保护controlStream, Shutdown可能在握手期间关闭连接
+	rawStreams    sync.Map       // 无分包的流 RawStreamI *RawStream
+	frameStreams  sync.Map       // 帧流 FrameStreamI *FrameStream
+	group         sync.WaitGroup // 正在执行的router handler
+	properties    sync.Map
+	maxFrameSize  int        // 该连接上帧流的最大帧长度
+	openMu        sync.Mutex // 串行化向对端请求新流
+	datagramOnce  sync.Once
+	datagrams     *DatagramChannel // 不可靠的datagram消息, 需双方开启EnableDatagrams
+	closeOnce     sync.Once
+	closeErr      error
+	onClose       func()     // 连接关闭后的回调, 由Server设置
+	hookMu        sync.Mutex // 保护onClose和closed
+	closed        bool
+	logger        *slog.Logger
+	tracer        TracerI
+	compressors   []CompressorI // 新帧流可协商的压缩, client按偏好排序
+	compressMin   int           // 压缩流上数据不小于该长度的帧才压缩
 }
 
 func (c *Connection) Close() error {
+	return c.closeWithError(ServerConnectionCloseCode, "server side close this conn")
+}
+
+// closeWithError closes all streams and the underlying quic conn with the given code,
+// only the first call takes effect.
+func (c *Connection) closeWithError(code quic.ApplicationErrorCode, msg string) error {
+	c.closeOnce.Do(func() {
+		c.hookMu.Lock()
+		c.closed = true
+		onClose := c.onClose
+		c.hookMu.Unlock()
+
+		c.closeErr = c.closeStreams(code, msg)
+		if onClose != nil {
+			onClose()
+		}
+	})
+	return c.closeErr
+}
+
+func (c *Connection) isClosed() bool {
+	c.hookMu.Lock()
+	defer c.hookMu.Unlock()
+	return c.closed
+}
 
-	c.controlStream.Close()
+// setOnClose sets the callback run once the conn is closed,
+// it reports false and keeps nothing if the conn is closed already.
+func (c *Connection) setOnClose(f func()) bool {
+	c.hookMu.Lock()
+	defer c.hookMu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.onClose = f
+	return true
+}
+
+func (c *Connection) closeStreams(code quic.ApplicationErrorCode, msg string) error {
+	if cs := c.getControlStream(); cs != nil {
+		cs.Close()
+	}
 
 	c.rawStreams.Range(func(key, value interface{}) bool {
 		stream := value.(RawStreamI)
@@ -52,7 +149,49 @@ func (c *Connection) Close() error {
 		return true
 	})
 
-	return c.qconn.CloseWithError(ServerConnectionCloseCode, "server side close this conn")
+	return c.qconn.CloseWithError(code, msg)
+}
+
+func (c *Connection) ID() ConnID {
+	return c.id
+}
+
+func (c *Connection) RemoteAddr() net.Addr {
+	return c.qconn.RemoteAddr()
+}
+
+// SetLogger sets the logger of this conn, the conn id and remote address are attached to every record.
+func (c *Connection) SetLogger(l *slog.Logger) {
+	c.logger = l.With(slog.Uint64(LogKeyConnID, uint64(c.id)), slog.String(LogKeyRemoteAddr, c.RemoteAddr().String()))
+}
+
+func (c *Connection) Logger() *slog.Logger {
+	return c.logger
+}
+
+// SetTracer sets the tracer which starts a span for every frame request on this conn.
+func (c *Connection) SetTracer(t TracerI) {
+	c.tracer = t
+}
+
+func (c *Connection) Tracer() TracerI {
+	return c.tracer
+}
+
+func (c *Connection) SetProperty(key string, value interface{}) {
+	c.properties.Store(key, value)
+}
+
+func (c *Connection) GetProperty(key string) (interface{}, error) {
+	value, ok := c.properties.Load(key)
+	if !ok {
+		return nil, fmt.Errorf("err get property %s", key)
+	}
+	return value, nil
+}
+
+func (c *Connection) RemoveProperty(key string) {
+	c.properties.Delete(key)
 }
 
 func (c *Connection) GetQConn() (quic.Connection, error) {
@@ -76,10 +215,19 @@ func (c *Connection) GetFrameStream(id StreamID) (FrameStreamI, error) {
 }
 
 func (c *Connection) setControlStream(stream FrameStreamI) error {
+	c.csMu.Lock()
+	defer c.csMu.Unlock()
 	c.controlStream = stream
 	return nil
 }
 
+// getControlStream returns the control stream for the goroutines other than the one serving the conn.
+func (c *Connection) getControlStream() FrameStreamI {
+	c.csMu.RLock()
+	defer c.csMu.RUnlock()
+	return c.controlStream
+}
+
 func (c *Connection) addRawStream(id StreamID, stream RawStreamI) error {
 	c.rawStreams.Store(id, stream)
 	return nil
@@ -104,8 +252,219 @@ func (c *Connection) OpenStreamSync() (quic.Stream, error) {
 	return c.qconn.OpenStreamSync(c.ctx)
 }
 
+// GetDatagramChannel returns the datagram channel of this conn,
+// ErrDatagramNotSupported if datagrams are not negotiated.
+func (c *Connection) GetDatagramChannel() (DatagramChannelI, error) {
+	if !c.qconn.ConnectionState().SupportsDatagrams {
+		return nil, ErrDatagramNotSupported
+	}
+	c.datagramOnce.Do(func() {
+		c.datagrams = NewDatagramChannel(c.qconn)
+	})
+	return c.datagrams, nil
+}
+
+// SetMaxFrameSize sets the max frame size of frame streams created on this conn afterwards.
+func (c *Connection) SetMaxFrameSize(size int) {
+	c.maxFrameSize = size
+}
+
+// SetCompression sets the compressors negotiable for new frame streams and the min data len
+// of a compressed frame, <=0 for DefaultCompressMinSize.
+func (c *Connection) SetCompression(minSize int, cs ...CompressorI) {
+	c.compressMin = minSize
+	c.compressors = cs
+}
+
+func (c *Connection) compressStream(fs *FrameStream, cp CompressorI) {
+	fs.setCompression(cp, c.compressMin)
+}
+
+func (c *Connection) newFrameStream(s quic.Stream) *FrameStream {
+	fs := NewFrameStream(s)
+	fs.SetMaxFrameSize(c.maxFrameSize)
+	return fs
+}
+
+// frameCloseCode picks the close code for a frame stream read error.
+func frameCloseCode(err error) quic.ApplicationErrorCode {
+	if errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrShortFrame) {
+		return FrameErrorCloseCode
+	}
+	return ServerConnectionCloseCode
+}
+
+// isStreamReset reports whether err is caused by resetting only the stream, by either side.
+func isStreamReset(err error) bool {
+	var se *quic.StreamError
+	return errors.As(err, &se)
+}
+
+// Wait blocks until all in-flight router handlers of this conn have returned,
+// handlers of msgs read meanwhile are waited too, use ServerConnection.Shutdown to stop taking new msgs.
 func (c *Connection) Wait() { c.group.Wait() }
 
+// Done is closed when the underlying quic conn is closed.
+func (c *Connection) Done() <-chan struct{} { return c.qconn.Context().Done() }
+
+// requestRawStream asks the peer to open a new raw stream over the control stream,
+// and accepts the stream opened by the peer.
+func (c *Connection) requestRawStream() (*RawStream, StreamID, error) {
+	if c.controlStream == nil {
+		return nil, 0, fmt.Errorf("controlStream is nil")
+	}
+	// 同一时刻只等待一个对端打开的流, 避免raw流和frame流错配
+	c.openMu.Lock()
+	defer c.openMu.Unlock()
+
+	err := c.controlStream.WriteMsg(NewRequestRawStreamMsg([]byte{}))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.logger.Debug("request new raw stream, awaiting")
+	newQStream, err := c.qconn.AcceptStream(c.ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	newStream := NewRawStream(newQStream)
+	// raw流的第一个字节是未分帧的Ack
+	err = readRawAck(newStream)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.logger.Debug("new raw stream accepted", streamAttr(newStream.StreamID()))
+
+	c.addRawStream(newStream.StreamID(), newStream)
+
+	return newStream, newStream.StreamID(), nil
+}
+
+// requestFrameStream asks the peer to open a new frame stream over the control stream,
+// and accepts the stream opened by the peer.
+// The stream is bound to the one of mps chosen by the peer, or the default protocol if mps is empty.
+func (c *Connection) requestFrameStream(mps ...MsgProtocolI) (*FrameStream, StreamID, error) {
+	if c.controlStream == nil {
+		return nil, 0, fmt.Errorf("controlStream is nil")
+	}
+	request := NewRequestFrameStreamMsg([]byte{})
+	if len(mps) > 0 {
+		versions := make([]string, 0, len(mps))
+		for _, mp := range mps {
+			if mp.Name() != mps[0].Name() {
+				return nil, 0, fmt.Errorf("%w: versions of different protocols %s and %s", ErrBadProtocolName, mps[0].Name(), mp.Name())
+			}
+			versions = append(versions, mp.Version())
+		}
+		var err error
+		request, err = BuildRequestFrameStreamMsg(mps[0].Name(), versions...)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(c.compressors) > 0 {
+		names := make([]string, 0, len(c.compressors))
+		for _, cp := range c.compressors {
+			names = append(names, cp.Name())
+		}
+		data, err := appendCompressors(request.data, names...)
+		if err != nil {
+			return nil, 0, err
+		}
+		request = NewRequestFrameStreamMsg(data)
+	}
+	c.openMu.Lock()
+	defer c.openMu.Unlock()
+
+	err := c.controlStream.WriteMsg(request)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.logger.Debug("request new frame stream, awaiting")
+	newQStream, err := c.qconn.AcceptStream(c.ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	newStream := c.newFrameStream(newQStream)
+	// 新流的第一帧是控制协议的Ack
+	newStream.BindMsgProtocol(controlMsgProtocol)
+	f, err := newStream.ReadMsg()
+	if err != nil {
+		newStream.CloseWithError(BadAckStreamCode)
+		return nil, 0, err
+	}
+
+	switch m := f.(type) {
+	case *AckStreamMsg:
+		c.logger.Debug("new frame stream accepted", streamAttr(newStream.StreamID()))
+		mp, err := ackedProtocol(m, mps)
+		if err == nil {
+			err = c.ackedCompression(newStream, m)
+		}
+		if err != nil {
+			newStream.Close()
+			return nil, 0, err
+		}
+		newStream.BindMsgProtocol(mp)
+		newStream.requested = mps
+		c.addFrameStream(newStream.StreamID(), newStream)
+		return newStream, newStream.StreamID(), nil
+	case *RejectStreamMsg:
+		newStream.Close()
+		return nil, 0, fmt.Errorf("%w: %s", ErrStreamRejected, m.GetData())
+	default:
+		newStream.CloseWithError(BadAckStreamCode)
+		return nil, 0, fmt.Errorf("not receive Ack")
+	}
+}
+
+// ackedProtocol returns the one of mps whose version is acked by the peer, or the default protocol if mps is empty.
+func ackedProtocol(ack *AckStreamMsg, mps []MsgProtocolI) (MsgProtocolI, error) {
+	if len(mps) == 0 {
+		return defaultMsgProtocol, nil
+	}
+	name, version, err := ack.Protocol()
+	if err != nil {
+		return nil, err
+	}
+	for _, mp := range mps {
+		if mp.Name() == name && mp.Version() == version {
+			return mp, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: peer acked %s %s", ErrProtocolNotFound, name, version)
+}
+
+// ackedCompression compresses stream by the compressor acked by the peer, if any.
+func (c *Connection) ackedCompression(stream *FrameStream, ack *AckStreamMsg) error {
+	name, err := ack.Compressor()
+	if err != nil {
+		return err
+	}
+	cp, err := compressorOf(name, c.compressors)
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		c.compressStream(stream, cp)
+	}
+	return nil
+}
+
+func readRawAck(stream io.Reader) error {
+	ack := NewAckStreamMsg([]byte{}).Encode()
+	buf := make([]byte, len(ack))
+	_, err := io.ReadFull(stream, buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, ack) {
+		return fmt.Errorf("not receive Ack")
+	}
+	return nil
+}
+
 // Server Connection impliment specisal
 type ConnectionIS interface {
 	ConnectionI
@@ -114,9 +473,21 @@ type ConnectionIS interface {
 	BindRawRouters([]RawRouterI)
 	// 绑定frame流对应的协议
 	BindMsgProtocol(sId StreamID, mP MsgProtocolI) error
+	negotiateProtocol(m *RequestFrameStreamMsg) (MsgProtocolI, error)
+	negotiateCompressor(m *RequestFrameStreamMsg) CompressorI
 	controlStreamLoop()
 	ProcessRawStream(stream RawStreamI)
 	ProcessFrameStream(stream FrameStreamI)
+	ProcessDatagrams(channel DatagramChannelI)
+	GoAway(reason string) error
+	Shutdown(ctx context.Context) error
+	// server主动向client打开流
+	OpenNewRawStream(splitter ...SplitterI) (RawStreamI, StreamID, error)
+	OpenNewFrameStream() (FrameStreamI, StreamID, error)
+	// topic订阅, 发布的msg经由帧流sId推送给client
+	Subscribe(topic string, sId StreamID) error
+	Unsubscribe(topic string)
+	Publish(topic string, m MsgI) int
 }
 
 type ServerConnection struct {
@@ -124,50 +495,136 @@ type ServerConnection struct {
 	RawRouters                []RawRouterI
 	requestRawStreamMsgChan   chan *RequestRawStreamMsg   // 管理无分包的流
 	requestFrameStreamMsgChan chan *RequestFrameStreamMsg // 管理分包的流
+	broker                    *Broker                     // 由Server设置
+	datagramProtocol          MsgProtocolI                // 非nil时处理datagram, 由Server设置
+	datagramRouters           map[MsgType]DatagramRouterI
+	metrics                   *serverMetrics // 由Server设置
+	frameMiddlewares          []FrameMiddleware
+	rawMiddlewares            []RawMiddleware
+	rawSplitter               SplitterI         // 流未绑定splitter时使用
+	pooledFrames              bool              // 帧读入池化buffer, handler结束后归还
+	protocols                 *ProtocolRegistry // 由Server设置, nil时只有默认协议
+	errorHandler              ErrorHandler
+	dispatchMode              DispatchMode
+	pool                      *WorkerPool // DispatchPool时由Server设置
+	datagramSeq               uint64
+	drainMu                   sync.Mutex
+	draining                  bool // Shutdown开始后不再接收新的handler
 	// FrameRouters []FrameRouterI
 }
 
 func NewServerConnection(ctx context.Context, qconn quic.Connection) *ServerConnection {
-	return &ServerConnection{Connection: Connection{ctx: ctx, qconn: qconn},
-		requestRawStreamMsgChan: make(chan *RequestRawStreamMsg, 10), requestFrameStreamMsgChan: make(chan *RequestFrameStreamMsg, 10)}
+	return &ServerConnection{Connection: Connection{id: nextConnID(), ctx: ctx, qconn: qconn, maxFrameSize: DefaultMaxFrameSize, logger: discardLogger, tracer: noopTracer{}},
+		requestRawStreamMsgChan: make(chan *RequestRawStreamMsg, 10), requestFrameStreamMsgChan: make(chan *RequestFrameStreamMsg, 10),
+		metrics: &serverMetrics{}, errorHandler: LogError}
 }
 
 func (sc *ServerConnection) Serve(ctx context.Context) <-chan struct{} {
 	done := make(chan struct{})
 
 	qconn := sc.qconn
-
-	// wg := new(sync.WaitGroup)
+	start := time.Now()
 
 	qStream, err := qconn.AcceptStream(ctx)
 	if err != nil {
-		fmt.Println(err)
+		sc.metrics.handshakeFailures.Inc()
+		sc.logger.Warn("accept control stream failed", "err", err)
+		close(done)
+		return done
 	}
-	defer qStream.Close()
 
-	controlStream := NewFrameStream(qStream)
+	controlStream := sc.newFrameStream(qStream)
 	controlStream.BindMsgProtocol(controlMsgProtocol)
 
 	sc.setControlStream(controlStream)
 
+	// client打开控制流后先发送Hello, server回复Hello
+	err = sc.helloHandshake()
+	if err != nil {
+		sc.metrics.handshakeFailures.Inc()
+		sc.logger.Warn("control stream handshake failed", "err", err)
+		close(done)
+		return done
+	}
+	sc.metrics.handshakeDuration.ObserveSince(start)
+
 	// 启动流管理器
 	go sc.controlStreamLoop()
 
-	// 进行控制流管理循环
+	if sc.datagramProtocol != nil {
+		channel, err := sc.GetDatagramChannel()
+		if err != nil {
+			sc.logger.Info("datagrams disabled", "err", err) // client未开启datagram
+		} else {
+			channel.BindMsgProtocol(sc.datagramProtocol)
+			for tag, r := range sc.datagramRouters {
+				channel.AddRouter(tag, r) // tag已由NewServer校验
+			}
+			go sc.ProcessDatagrams(channel)
+		}
+	}
+
+	// 进行控制流管理循环, conn关闭后通知done
 	go func(sc *ServerConnection) {
+		defer close(done)
 
-		defer sc.Close()
+		sc.StreamManager(ctx)
 
 		select {
 		case <-ctx.Done():
-			return
-		case <-sc.StreamManager(ctx):
+		case <-sc.Done():
 		}
 	}(sc)
 
 	return done
 }
 
+func (sc *ServerConnection) helloHandshake() error {
+	m, err := sc.controlStream.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if _, ok := m.(*HelloMsg); !ok {
+		return fmt.Errorf("control stream not receive Hello")
+	}
+	return sc.controlStream.WriteMsg(NewHelloMsg([]byte{}))
+}
+
+// GoAway tells the client over the control stream that the server is going away.
+func (sc *ServerConnection) GoAway(reason string) error {
+	cs := sc.getControlStream()
+	if cs == nil {
+		return fmt.Errorf("controlStream is nil")
+	}
+	return cs.WriteMsg(NewGoAwayMsg([]byte(reason)))
+}
+
+// Shutdown sends GoAway to the client, waits for in-flight handlers until ctx is done,
+// then closes the conn with ServerShutdownCloseCode. The msgs read after Shutdown starts are
+// dropped and passed to the ErrorHandler with ErrRequestDropped.
+func (sc *ServerConnection) Shutdown(ctx context.Context) error {
+	sc.GoAway("server shutdown")
+	sc.drainMu.Lock()
+	sc.draining = true // 此后track失败, group不再Add, Wait才是安全的
+	sc.drainMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		sc.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	sc.closeWithError(ServerShutdownCloseCode, "server shutdown")
+	return err
+}
+
 func (sc *ServerConnection) controlStreamLoop() {
 	// if sc.requestRawStreamMsgChan == nil {
 	// 	sc.requestRawStreamMsgChan = make(chan MsgI, 10)
@@ -178,26 +635,34 @@ func (sc *ServerConnection) controlStreamLoop() {
 
 	for {
 		m, err := sc.controlStream.ReadMsg()
+		if errors.Is(err, ErrUnknownMsg) {
+			// 较新的对端发送的控制msg, 忽略
+			sc.logger.Warn("unknown control msg")
+			continue
+		}
 		if err != nil {
-			sc.qconn.CloseWithError(0, err.Error())
+			sc.logger.Debug("control stream closed", "err", err)
+			sc.closeWithError(frameCloseCode(err), err.Error())
 			return
 		}
 
-		// fmt.Println(thisMsgType.)
-		fmt.Println(sc.requestRawStreamMsgChan)
+		sc.logger.Debug("control msg received", msgTypeAttr(m))
 		typeCode := m.Type()
 		switch typeCode.(ControlMsgType) { // TODO, 这里确实需要msg.(type)才能变到这样，怀疑是多层ControlMsgI返回导致无法解析到类型,做到协议，只做一层传出
 		case RequestRawStreamMsgTag:
-			fmt.Println("tes1")
 			sc.requestRawStreamMsgChan <- m.(*RequestRawStreamMsg)
-			fmt.Println("tes1")
 		case RequestFrameStreamMsgTag:
-			fmt.Println("tes2")
 			sc.requestFrameStreamMsgChan <- m.(*RequestFrameStreamMsg)
-			fmt.Println("tes2")
+		case SubscribeMsgTag, UnsubscribeMsgTag:
+			req := &FrameRequest{conn: sc, stream: sc.controlStream, msg: m}
+			router, err := sc.controlStream.GetRouter(typeCode)
+			if err != nil {
+				sc.logger.Warn("no router for control msg", msgTypeAttr(m), "err", err)
+				continue
+			}
+			sc.handleControlRequest(router, req)
 		default:
-			fmt.Println("default", m)
-			fmt.Println("control stream read unexcepted", "control msg type")
+			sc.logger.Warn("unexpected control msg", msgTypeAttr(m))
 		}
 	}
 }
@@ -205,126 +670,634 @@ func (sc *ServerConnection) controlStreamLoop() {
 func (sc *ServerConnection) StreamManager(ctx context.Context) chan struct{} {
 	// sc.group.Add(2)
 	go sc.rawStreamManager(ctx)
-	fmt.Println("start raw stream manager")
 	go sc.frameStreamManager(ctx)
-	fmt.Println("start frame stream manager")
+	sc.logger.Debug("stream managers started")
 	return make(chan struct{})
 }
 
 func (sc *ServerConnection) rawStreamManager(ctx context.Context) chan struct{} {
 	for {
-		fmt.Printf("awating a new raw msg\n")
-
-		ff, ok := <-sc.requestRawStreamMsgChan
-		fmt.Println(ff)
-		if !ok {
-			fmt.Println(io.EOF)
+		var msg *RequestRawStreamMsg
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sc.Done():
+			return nil
+		case msg = <-sc.requestRawStreamMsgChan:
 		}
-		msg := ff
 		// 将msg转为request，此举是为了后续扩展多个msg形成一个request
 		req := &FrameRequest{conn: sc, stream: sc.controlStream, msg: msg}
 
 		router, err := sc.controlStream.GetRouter(msg.Type())
 		if err != nil {
-			fmt.Println(err)
+			sc.logger.Warn("no router for control msg", msgTypeAttr(msg), "err", err)
+			continue
 		}
 
-		go func(req *FrameRequest) {
-			router.PreHandler(req)
-			router.Handler(req)
-			router.AfterHandler(req)
-		}(req)
+		sc.handleControlRequest(router, req)
 	}
 }
 
 func (sc *ServerConnection) frameStreamManager(ctx context.Context) chan struct{} {
 	for {
-		fmt.Printf("awating a new frame msg")
-		ff, ok := <-sc.requestFrameStreamMsgChan
-		fmt.Println(ff)
-		if !ok {
-			fmt.Println(io.EOF)
+		var msg *RequestFrameStreamMsg
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sc.Done():
+			return nil
+		case msg = <-sc.requestFrameStreamMsgChan:
 		}
-		msg := ff
 		// 将msg转为request，此举是为了后续扩展多个msg形成一个request
 		req := &FrameRequest{conn: sc, stream: sc.controlStream, msg: msg}
 
 		router, err := sc.controlStream.GetRouter(msg.Type())
 		if err != nil {
-			fmt.Println(err)
+			sc.logger.Warn("no router for control msg", msgTypeAttr(msg), "err", err)
+			continue
+		}
+
+		sc.handleControlRequest(router, req)
+	}
+}
+
+// frameHandler wraps router with the server middlewares and the middlewares of the stream's protocol.
+func (sc *ServerConnection) frameHandler(stream FrameStreamI, tag MsgType, router FrameRouterI) FrameHandlerFunc {
+	mws := sc.frameMiddlewares
+	if mp, ok := stream.GetMsgProtocol().(FrameMiddlewaresI); ok {
+		protocolMws := mp.FrameMiddlewares(tag)
+		if len(protocolMws) > 0 {
+			mws = append(append([]FrameMiddleware{}, mws...), protocolMws...)
+		}
+	}
+	return ChainFrame(FrameRouterHandler(router), mws...)
+}
+
+// track adds a handler to the conn's group, it returns false once Shutdown started draining.
+func (sc *ServerConnection) track() bool {
+	sc.drainMu.Lock()
+	defer sc.drainMu.Unlock()
+	if sc.draining {
+		return false
+	}
+	sc.group.Add(1)
+	return true
+}
+
+// drop reports req which is not handled, see ErrRequestDropped.
+func (sc *ServerConnection) drop(req RequestI) {
+	sc.metrics.msgsDropped.Inc()
+	sc.errorHandler(req, ErrRequestDropped)
+	switch r := req.(type) {
+	case *FrameRequest:
+		r.replyIfUnanswered(ErrRequestDropped)
+		r.finish()
+	case *RawRequest:
+		r.release()
+		r.finish()
+	}
+}
+
+// dispatch runs task of req by the dispatch mode of the conn, tracked by the conn's group for draining.
+// key keeps the tasks of a stream in order on the worker pool. It returns false if task was dropped.
+func (sc *ServerConnection) dispatch(key uint64, req RequestI, task func()) bool {
+	if !sc.track() {
+		sc.drop(req)
+		return false
+	}
+	switch {
+	case sc.dispatchMode == DispatchSerial:
+		defer sc.group.Done()
+		task()
+	case sc.dispatchMode == DispatchPool && sc.pool != nil:
+		ok := sc.pool.Submit(key, func() {
+			defer sc.group.Done()
+			task()
+		}, func() {
+			defer sc.group.Done()
+			sc.drop(req)
+		}, sc.Done())
+		if !ok {
+			// 连接已关闭或worker池已停止
+			sc.group.Done()
+			sc.drop(req)
+			return false
+		}
+	default:
+		go func() {
+			defer sc.group.Done()
+			task()
+		}()
+	}
+	return true
+}
+
+// handleControlRequest runs the router of a control msg in a new goroutine, whatever the dispatch mode is.
+func (sc *ServerConnection) handleControlRequest(router FrameRouterI, req *FrameRequest) {
+	if !sc.track() {
+		sc.drop(req)
+		return
+	}
+	go func() {
+		defer sc.group.Done()
+		sc.runFrameRequest(FrameRouterHandler(router), req)
+	}()
+}
+
+// handleFrameRequest dispatches h, the msgs of one stream share the same dispatch key.
+func (sc *ServerConnection) handleFrameRequest(h FrameHandlerFunc, req *FrameRequest) {
+	sc.dispatch(dispatchKey(sc.id, req.stream.StreamID()), req, func() {
+		sc.runFrameRequest(h, req)
+	})
+}
+
+// runFrameRequest runs h in a span, the child of the span sent by the peer.
+func (sc *ServerConnection) runFrameRequest(h FrameHandlerFunc, req *FrameRequest) {
+	if req.ctx == nil {
+		req.ctx = sc.ctx
+	}
+	ctx, span := sc.tracer.Start(req.ctx, "dollop.frame")
+	req.ctx = ctx
+	span.SetAttribute(LogKeyConnID, uint64(sc.id))
+	span.SetAttribute(LogKeyStreamID, int64(req.stream.StreamID()))
+	span.SetAttribute(LogKeyMsgType, req.msg.Type())
+
+	start := time.Now()
+	err := safeCall(func() error { return h(req) })
+	sc.metrics.frameHandlerDuration.ObserveSince(start)
+
+	if err != nil {
+		span.RecordError(err)
+		sc.errorHandler(req, err)
+		req.replyIfUnanswered(err) // ErrorHandler未回复时也要结束对端的Call
+	} else {
+		req.replyIfUnanswered(ErrNoReply)
+	}
+	span.End()
+	if req.frame != nil {
+		req.frame.Release()
+	}
+	req.finish()
+}
+
+// handleRawRequest dispatches all raw routers wrapped by the raw middlewares.
+func (sc *ServerConnection) handleRawRequest(req *RawRequest) {
+	h := ChainRaw(RawRoutersHandler(sc.RawRouters), sc.rawMiddlewares...)
+	if req.inflight != nil {
+		req.inflight.Add(1)
+	}
+	sc.dispatch(dispatchKey(sc.id, req.stream.StreamID()), req, func() {
+		defer req.finish()
+		defer req.release()
+		start := time.Now()
+		err := safeCall(func() error { return h(req) })
+		sc.metrics.rawHandlerDuration.ObserveSince(start)
+		if err != nil {
+			sc.errorHandler(req, err)
 		}
+	})
+}
 
-		go func(req *FrameRequest) {
-			router.PreHandler(req)
-			router.Handler(req)
-			router.AfterHandler(req)
-		}(req)
+// rawReadSize returns the largest read size asked by the raw routers, or DefaultRawReadSize.
+func (sc *ServerConnection) rawReadSize() int {
+	size := 0
+	for _, r := range sc.RawRouters {
+		if rs, ok := r.(RawReadSizerI); ok && rs.ReadSize() > size {
+			size = rs.ReadSize()
+		}
+	}
+	if size <= 0 {
+		return DefaultRawReadSize
+	}
+	return size
+}
+
+// handleDatagramRequest dispatches the router, datagrams have no order so each gets its own key.
+func (sc *ServerConnection) handleDatagramRequest(router DatagramRouterI, req *DatagramRequest) {
+	sc.datagramSeq++
+	sc.dispatch(dispatchKey(sc.id, StreamID(sc.datagramSeq)), req, func() {
+		err := safeCall(func() error {
+			err := router.PreHandler(req)
+			if err != nil {
+				return err
+			}
+			err = router.Handler(req)
+			afterErr := router.AfterHandler(req)
+			if err != nil {
+				return err
+			}
+			return afterErr
+		})
+		if err != nil {
+			sc.errorHandler(req, err)
+		}
+	})
+}
+
+func (sc *ServerConnection) ProcessDatagrams(channel DatagramChannelI) {
+	for {
+		m, err := channel.ReadMsg()
+		if errors.Is(err, ErrUnknownMsg) {
+			// datagram不可靠, 单个msg解析失败不影响后续msg
+			sc.metrics.msgsDropped.Inc()
+			sc.logger.Debug("unknown datagram msg", "err", err)
+			continue
+		}
+		if err != nil {
+			// 连接已关闭或不支持datagram, 继续读取只会空转
+			sc.logger.Debug("datagram channel closed", "err", err)
+			return
+		}
+
+		req := &DatagramRequest{conn: sc, channel: channel, msg: m}
+		router, err := channel.GetRouter(m.Type())
+		if err != nil {
+			sc.metrics.msgsDropped.Inc()
+			sc.logger.Warn("no router for datagram msg", msgTypeAttr(m), "err", err)
+			continue
+		}
+
+		sc.handleDatagramRequest(router, req)
 	}
 }
 
 func (sc *ServerConnection) ProcessRawStream(stream RawStreamI) {
-	fmt.Println("process raw stream", stream.StreamID())
-	buf := make([]byte, 512) // 分配一次，重复使用 // TODO，将切分逻辑交给路由
+	sc.logger.Debug("process raw stream", streamAttr(stream.StreamID()))
+	sc.metrics.rawStreams.Inc()
+	sc.metrics.rawStreamsActive.Inc()
+	defer sc.metrics.rawStreamsActive.Dec()
+	var inflight sync.WaitGroup
+	defer sc.rawStreamEnded(stream, &inflight)
+	if sc.rawSplitterOf(stream) != nil {
+		sc.processRawRecords(stream, &inflight)
+		return
+	}
+
+	size := sc.rawReadSize()
 	for {
-		// 判断ctx业务退出?
+		// router处理请求时为流绑定的splitter, 从其后开始的读取生效
+		if stream.Splitter() != nil {
+			sc.processRawRecords(stream, &inflight)
+			return
+		}
 
-		// 读取数据
-		_, err := stream.Read(buf[:])
+		// 每次读取使用新的池化buffer, 由handleRawRequest在handler结束后归还
+		buf := getBuf(size)
+		n, err := stream.Read(*buf)
+		sc.metrics.rawBytesReceived.Add(uint64(n))
+		if n > 0 {
+			// 将数据请求封装为request，交给router处理, Read返回错误时也可能带有数据
+			sc.handleRawRequest(&RawRequest{conn: sc, stream: stream, data: (*buf)[:n], buf: buf, inflight: &inflight})
+		} else {
+			putBuf(buf)
+		}
 		if err != nil {
-			// fmt.Println(err) // 客户端退出后，会触发超时
-			break
+			// 对端关闭或重置该流, 或连接已关闭; 连接的关闭由控制流负责
+			sc.logger.Debug("raw stream closed", streamAttr(stream.StreamID()), "err", err)
+			return
 		}
-		// 将数据请求封装为request，然后分别调用对应的router
-		// 生成request
-		req := &RawRequest{conn: sc, stream: stream, data: buf} // 重复使用buf的前提是这里传值而不是传指针
+	}
+}
 
-		// 交给router处理
-		go func(req *RawRequest) {
-			for _, ri := range sc.RawRouters {
-				ri.PreHandler(req)
-				ri.Handler(req)
-				ri.AfterHandler(req)
-			}
-		}(req)
+// rawStreamEnded removes stream after reading it ended, and closes its sending side once its in-flight
+// handlers returned. Otherwise the stream is never finished and keeps a slot of the peer's MaxIncomingStreams.
+func (sc *ServerConnection) rawStreamEnded(stream RawStreamI, inflight *sync.WaitGroup) {
+	sc.deleteRawStream(stream.StreamID())
+	go func() {
+		inflight.Wait()
+		stream.Close()
+	}()
+}
+
+// rawSplitterOf returns the splitter of stream: its own, the one of the raw routers, or the one set by WithRawSplitter.
+func (sc *ServerConnection) rawSplitterOf(stream RawStreamI) SplitterI {
+	if s := stream.Splitter(); s != nil {
+		return s
+	}
+	for _, r := range sc.RawRouters {
+		if rs, ok := r.(RawSplitterI); ok && rs.Splitter() != nil {
+			return rs.Splitter()
+		}
 	}
-	// fmt.Println("close conn") // 客户端退出，触发超时，关闭流
-	sc.Close()
+	return sc.rawSplitter
+}
+
+// processRawRecords reads stream by its splitter, each record is copied into a pooled buffer for its RawRequest.
+// The splitter is looked up for every record, so one bound to the stream meanwhile applies to the next record.
+func (sc *ServerConnection) processRawRecords(stream RawStreamI, inflight *sync.WaitGroup) {
+	maxSize := sc.maxFrameSize
+	if maxSize <= 0 {
+		maxSize = math.MaxInt32
+	}
+	var splitErr error
+	scanner := bufio.NewScanner(&countingReader{r: stream, counter: sc.metrics.rawBytesReceived})
+	scanner.Buffer(make([]byte, sc.rawReadSize()), maxSize)
+	splitter := sc.rawSplitterOf(stream)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if s := sc.rawSplitterOf(stream); s != nil {
+			splitter = s
+		}
+		advance, record, err := splitter.Split(data, atEOF)
+		splitErr = err
+		return advance, record, err
+	})
+	for scanner.Scan() {
+		record := scanner.Bytes()
+		buf := getBuf(len(record))
+		copy(*buf, record)
+		sc.handleRawRequest(&RawRequest{conn: sc, stream: stream, data: *buf, buf: buf, inflight: inflight})
+	}
+
+	err := scanner.Err()
+	if splitErr != nil || errors.Is(err, bufio.ErrTooLong) {
+		// 剩余数据已无法切分, 重置该流, 连接继续使用
+		sc.logger.Warn("split raw stream failed", streamAttr(stream.StreamID()), "err", err)
+		stream.CloseWithError(SplitErrorStreamCode)
+		return
+	}
+	sc.logger.Debug("raw stream closed", streamAttr(stream.StreamID()), "err", err)
 }
 
 func (sc *ServerConnection) ProcessFrameStream(stream FrameStreamI) {
-	fmt.Println("process frame stream", stream.StreamID())
+	sc.logger.Debug("process frame stream", streamAttr(stream.StreamID()))
+	sc.metrics.frameStreams.Inc()
+	sc.metrics.frameStreamsActive.Inc()
+	defer sc.metrics.frameStreamsActive.Dec()
+	var inflight sync.WaitGroup
 	for {
 		// 判断ctx业务退出? 是否有必要
 
 		// 读取数据
-		f, err := stream.ReadMsg()
+		f, err := sc.readFrame(stream)
 		if err != nil {
-			// fmt.Println(err) // 客户端退出后，会触发超时
-			break
+			sc.frameStreamFailed(stream, err, &inflight)
+			return
+		}
+		sc.metrics.framesReceived.Inc()
+		if f.flags&FrameFlagError != 0 {
+			sc.logger.Debug("peer replied error", streamAttr(stream.StreamID()), "err", string(f.data))
+			f.Release()
+			continue
 		}
 		// 将数据请求封装为request，然后分别调用对应的router
 		// 生成request
-		req := &FrameRequest{conn: sc, stream: stream, msg: f}
-		router, err := stream.GetRouter(f.Type())
+		req := &FrameRequest{conn: sc, stream: stream, isCall: f.Flags()&FrameFlagCall != 0, callID: f.callID, ctx: sc.ctx, frame: f}
+		if spanCtx, ok := f.SpanContext(); ok {
+			req.ctx = ContextWithRemoteSpanContext(req.ctx, spanCtx)
+		}
+		var h FrameHandlerFunc
+		m, err := stream.decodeMsg(f)
 		if err != nil {
-			fmt.Println(err)
+			sc.metrics.msgsDropped.Inc()
+			sc.logger.Warn("decode msg failed", streamAttr(stream.StreamID()), "err", err)
+			if req.isCall {
+				req.ReplyError(err) // 避免对端的Call一直等待
+			}
+		} else {
+			req.msg = m
+			h = sc.routeFrameRequest(stream, req)
+		}
+		if h != nil {
+			req.inflight = &inflight
+			inflight.Add(1)
 		}
 
+		if f.flags&FrameFlagChunk != 0 {
+			// 分块msg, 其后的帧为body
+			err = sc.handleChunkedRequest(stream, f, h, req)
+			if err != nil {
+				sc.frameStreamFailed(stream, err, &inflight)
+				return
+			}
+			continue
+		}
+		if h == nil {
+			f.Release()
+			continue
+		}
 		// 交给router处理
-		go func(req *FrameRequest) {
-			router.PreHandler(req)
-			router.Handler(req)
-			router.AfterHandler(req)
-		}(req)
+		sc.handleFrameRequest(h, req)
+	}
+}
+
+// readFrame reads the next frame of stream, into a pooled buffer if WithFrameBufferPool is set.
+func (sc *ServerConnection) readFrame(stream FrameStreamI) (*Frame, error) {
+	if sc.pooledFrames {
+		return stream.readPooledFrame()
 	}
-	// fmt.Println("close conn") // 客户端退出，触发超时，关闭流
-	sc.Close()
+	return stream.readFrame()
+}
+
+// frameStreamFailed ends a frame stream after reading it failed. A stream closed or reset by the peer
+// is finished by closing its sending side once its in-flight handlers returned, otherwise it keeps
+// a slot of the peer's MaxIncomingStreams.
+func (sc *ServerConnection) frameStreamFailed(stream FrameStreamI, err error, inflight *sync.WaitGroup) {
+	// 客户端退出后，会触发超时
+	sc.logger.Debug("frame stream closed", streamAttr(stream.StreamID()), "err", err)
+	if err == io.EOF || isStreamReset(err) {
+		// 对端在帧边界正常关闭了该流(FIN), 或仅该流被重置, 如CloseStreamOnError, 连接继续使用
+		sc.deleteFrameStream(stream.StreamID())
+		var se *quic.StreamError
+		if errors.As(err, &se) {
+			stream.cancelRead(se.ErrorCode)
+		}
+		go func() {
+			inflight.Wait()
+			stream.Close()
+		}()
+		return
+	}
+	// 帧错误后流已无法对齐, 以FrameErrorCloseCode关闭连接
+	sc.closeWithError(frameCloseCode(err), err.Error())
+}
+
+// routeFrameRequest returns the handler of the msg of req, or nil after replying that it has no router.
+func (sc *ServerConnection) routeFrameRequest(stream FrameStreamI, req *FrameRequest) FrameHandlerFunc {
+	m := req.msg
+	router, err := stream.GetRouter(m.Type())
+	if err != nil {
+		router = fallbackRouter(stream.GetMsgProtocol())
+	}
+	if router == nil {
+		sc.metrics.msgsDropped.Inc()
+		sc.logger.Warn("no router for msg", streamAttr(stream.StreamID()), msgTypeAttr(m), "err", err)
+		sc.replyNotFound(stream, req)
+		return nil
+	}
+	return sc.frameHandler(stream, m.Type(), router)
+}
+
+// handleChunkedRequest dispatches h with the body of the chunked msg whose first frame is head,
+// then feeds the following chunks of the msg into the body. The chunks are skipped if h is nil
+// or returned without reading all of them. The returned error is the error of reading the stream.
+func (sc *ServerConnection) handleChunkedRequest(stream FrameStreamI, head *Frame, h FrameHandlerFunc, req *FrameRequest) error {
+	var pw *io.PipeWriter
+	done := make(chan struct{})
+	if h != nil {
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		req.body = pr
+		task := func() {
+			defer close(done)
+			defer pr.CloseWithError(ErrBodyClosed)
+			sc.runFrameRequest(h, req)
+		}
+		if sc.dispatchMode == DispatchSerial {
+			// handler读取body时需要本goroutine继续读帧, 在body结束后等待handler以保持顺序
+			if sc.track() {
+				go func() {
+					defer sc.group.Done()
+					task()
+				}()
+				defer func() { <-done }()
+			} else {
+				sc.drop(req)
+				pw = nil
+			}
+		} else if !sc.dispatch(dispatchKey(sc.id, stream.StreamID()), req, task) {
+			pw = nil
+		}
+	} else {
+		head.Release()
+	}
+
+	f := head
+	for f.flags&FrameFlagFinal == 0 {
+		var err error
+		f, err = sc.readFrame(stream)
+		if err == io.EOF {
+			err = fmt.Errorf("%w: stream ended before the final chunk", ErrBadChunk)
+		}
+		if err == nil && f.flags&FrameFlagChunk == 0 {
+			f.Release()
+			err = ErrBadChunk
+		}
+		if err != nil {
+			if pw != nil {
+				pw.CloseWithError(err)
+			}
+			return err
+		}
+		sc.metrics.framesReceived.Inc()
+		if pw != nil && f.flags&FrameFlagError != 0 {
+			// 对端读取body失败
+			pw.CloseWithError(&RemoteError{Msg: string(f.data)})
+			pw = nil
+		} else if pw != nil {
+			// Write在handler读完数据后才返回, 之后即可归还帧
+			_, err = pw.Write(f.data)
+			if err != nil {
+				pw = nil // handler已返回, 丢弃剩余的块
+			}
+		}
+		f.Release()
+	}
+	if pw != nil {
+		pw.Close()
+	}
+	return nil
+}
+
+func fallbackRouter(mp MsgProtocolI) FrameRouterI {
+	if fr, ok := mp.(FallbackRouterI); ok {
+		return fr.FallbackRouter()
+	}
+	return nil
+}
+
+// replyNotFound tells the peer that the msg of req has no router,
+// by the NotFound msg of the protocol or ErrRouterNotFound.
+func (sc *ServerConnection) replyNotFound(stream FrameStreamI, req *FrameRequest) {
+	var err error
+	if nf, ok := stream.GetMsgProtocol().(NotFoundReplierI); ok {
+		err = req.Reply(nf.NotFoundMsg(req.msg))
+	} else {
+		err = req.ReplyError(ErrRouterNotFound)
+	}
+	if err != nil {
+		sc.logger.Debug("reply not found failed", streamAttr(stream.StreamID()), "err", err)
+	}
+}
+
+// OpenNewRawStream opens a raw stream toward the client, e.g. to push game state.
+// The client is notified by Client.OnIncomingRawStream. The data sent by the client is split by splitter if given,
+// it is bound before the stream is read.
+func (sc *ServerConnection) OpenNewRawStream(splitter ...SplitterI) (RawStreamI, StreamID, error) {
+	newStream, id, err := sc.requestRawStream()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(splitter) > 0 {
+		newStream.BindSplitter(splitter[0])
+	}
+	go sc.ProcessRawStream(newStream)
+	return newStream, id, nil
+}
+
+// OpenNewFrameStream opens a frame stream toward the client, e.g. to push game state.
+// The client is notified by Client.OnIncomingFrameStream.
+func (sc *ServerConnection) OpenNewFrameStream() (FrameStreamI, StreamID, error) {
+	newStream, id, err := sc.requestFrameStream()
+	if err != nil {
+		return nil, 0, err
+	}
+	go sc.ProcessFrameStream(newStream)
+	return newStream, id, nil
+}
+
+func (sc *ServerConnection) Subscribe(topic string, sId StreamID) error {
+	if sc.broker == nil {
+		return fmt.Errorf("conn has no broker")
+	}
+	stream, err := sc.GetFrameStream(sId)
+	if err != nil {
+		return err
+	}
+	return sc.broker.Subscribe(sc, topic, stream)
+}
+
+func (sc *ServerConnection) Unsubscribe(topic string) {
+	if sc.broker != nil {
+		sc.broker.Unsubscribe(sc, topic)
+	}
+}
+
+// Publish fans out m to all conns subscribed to topic, not only this conn.
+func (sc *ServerConnection) Publish(topic string, m MsgI) int {
+	if sc.broker == nil {
+		return 0
+	}
+	return sc.broker.Publish(topic, m)
 }
 
 func (sc *ServerConnection) BindRawRouters(rs []RawRouterI) {
 	sc.RawRouters = append(sc.RawRouters, rs...)
 }
 
+// negotiateProtocol picks the registered msg protocol asked by m for a new frame stream.
+func (sc *ServerConnection) negotiateProtocol(m *RequestFrameStreamMsg) (MsgProtocolI, error) {
+	name, versions, err := m.Protocol()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return defaultMsgProtocol, nil
+	}
+	if sc.protocols == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProtocolNotFound, name)
+	}
+	return sc.protocols.Negotiate(name, versions)
+}
+
+// negotiateCompressor picks the first compressor asked by m which the server accepts, nil for none.
+func (sc *ServerConnection) negotiateCompressor(m *RequestFrameStreamMsg) CompressorI {
+	names, err := m.Compressors()
+	if err != nil {
+		return nil
+	}
+	return negotiateCompressor(names, sc.compressors)
+}
+
 func (sc *ServerConnection) BindMsgProtocol(sId StreamID, mP MsgProtocolI) error {
 	stream, err := sc.GetFrameStream(sId)
 	if err != nil {
@@ -340,62 +1313,122 @@ type ConnectionIC interface {
 	ConnectionI
 	// for Client connection
 	OpenNewRawStream() (RawStreamI, StreamID, error)
-	OpenNewFrameStream() (FrameStreamI, StreamID, error)
+	// OpenNewFrameStream asks for a frame stream bound to one of mps, the versions of one protocol
+	// in preference order, or the default protocol if mps is empty.
+	OpenNewFrameStream(mps ...MsgProtocolI) (FrameStreamI, StreamID, error)
 }
 
 type ClientConnection struct {
 	Connection
+	onIncomingRawStream   func(stream RawStreamI)   // server主动打开的流
+	onIncomingFrameStream func(stream FrameStreamI) // server主动打开的流
+	goAway                chan struct{}             // 收到server的GoAway后关闭
+	goAwayOnce            sync.Once
 }
 
 func NewClientConnection(ctx context.Context, qconn quic.Connection) *ClientConnection {
-	return &ClientConnection{Connection: Connection{ctx: ctx, qconn: qconn}}
+	return &ClientConnection{Connection: Connection{id: nextConnID(), ctx: ctx, qconn: qconn, maxFrameSize: DefaultMaxFrameSize, logger: discardLogger, tracer: noopTracer{}},
+		goAway: make(chan struct{})}
+}
+
+func (cc *ClientConnection) Close() error {
+	return cc.closeWithError(ClientConnectionCloseCode, "client side close this conn")
 }
 
 func (cc *ClientConnection) OpenNewRawStream() (RawStreamI, StreamID, error) {
+	return cc.requestRawStream()
+}
+
+func (cc *ClientConnection) OpenNewFrameStream(mps ...MsgProtocolI) (FrameStreamI, StreamID, error) {
+	return cc.requestFrameStream(mps...)
+}
+
+// GoingAway is closed after the server sent GoAway on the control stream.
+func (cc *ClientConnection) GoingAway() <-chan struct{} {
+	return cc.goAway
+}
+
+// Subscribe asks the server to deliver the msgs of topic on the frame stream sId.
+func (cc *ClientConnection) Subscribe(topic string, sId StreamID) error {
 	if cc.controlStream == nil {
-		return nil, 0, fmt.Errorf("controlStream is nil")
+		return fmt.Errorf("controlStream is nil")
 	}
+	return cc.controlStream.WriteMsg(BuildSubscribeMsg(topic, sId))
+}
 
-	cc.controlStream.WriteMsg(NewRequestRawStreamMsg([]byte{}))
-
-	fmt.Println("request new raw stream, awaiting")
-	newQStream, err := cc.qconn.AcceptStream(cc.ctx)
-	if err != nil {
-		return nil, 0, err
+func (cc *ClientConnection) Unsubscribe(topic string) error {
+	if cc.controlStream == nil {
+		return fmt.Errorf("controlStream is nil")
 	}
-	fmt.Println("reqeust success, new data stream", newQStream.StreamID())
-	newStream := NewRawStream(newQStream)
+	return cc.controlStream.WriteMsg(NewUnsubscribeMsg([]byte(topic)))
+}
 
-	cc.rawStreams.Store(newStream.StreamID(), newStream)
+// controlStreamLoop handles the stream requests sent by the server on the control stream,
+// the handshake is the mirror of the server side RequestRawStreamRouter/RequestFrameStreamRouter.
+func (cc *ClientConnection) controlStreamLoop() {
+	for {
+		m, err := cc.controlStream.ReadMsg()
+		if errors.Is(err, ErrUnknownMsg) {
+			cc.logger.Warn("unknown control msg")
+			continue
+		}
+		if err != nil {
+			cc.logger.Debug("control stream closed", "err", err)
+			return
+		}
 
-	return newStream, StreamID(newStream.StreamID()), nil
+		switch m.(type) {
+		case *RequestRawStreamMsg:
+			go cc.acceptRawStream()
+		case *RequestFrameStreamMsg:
+			go cc.acceptFrameStream()
+		case *GoAwayMsg:
+			cc.goAwayOnce.Do(func() { close(cc.goAway) })
+		default:
+			cc.logger.Warn("unexpected control msg", msgTypeAttr(m))
+		}
+	}
 }
 
-func (cc *ClientConnection) OpenNewFrameStream() (FrameStreamI, StreamID, error) {
-	if cc.controlStream == nil {
-		return nil, 0, fmt.Errorf("controlStream is nil")
+func (cc *ClientConnection) acceptRawStream() {
+	newQuicStream, err := cc.OpenStreamSync()
+	if err != nil {
+		cc.logger.Warn("open raw stream failed", "err", err)
+		return
 	}
+	cc.logger.Debug("open new raw stream", streamAttr(StreamID(newQuicStream.StreamID())))
 
-	cc.controlStream.WriteMsg(NewRequestFrameStreamMsg([]byte{}))
+	newStream := NewRawStream(newQuicStream)
+	_, err = newStream.Write(NewAckStreamMsg([]byte{}).Encode())
+	if err != nil {
+		cc.logger.Warn("ack raw stream failed", streamAttr(newStream.StreamID()), "err", err)
+		return
+	}
+	cc.addRawStream(newStream.StreamID(), newStream)
+
+	if cc.onIncomingRawStream != nil {
+		cc.onIncomingRawStream(newStream)
+	}
+}
 
-	fmt.Println("request new frame stream, awaiting")
-	newQStream, err := cc.qconn.AcceptStream(cc.ctx)
+func (cc *ClientConnection) acceptFrameStream() {
+	newQuicStream, err := cc.OpenStreamSync()
 	if err != nil {
-		return nil, 0, err
+		cc.logger.Warn("open frame stream failed", "err", err)
+		return
 	}
-	fmt.Println("get quic stream")
-	newStream := NewFrameStream(newQStream)
-	f, err := newStream.ReadMsg()
+	cc.logger.Debug("open new frame stream", streamAttr(StreamID(newQuicStream.StreamID())))
+
+	newStream := cc.newFrameStream(newQuicStream)
+	newStream.BindMsgProtocol(defaultMsgProtocol)
+	err = newStream.WriteMsg(NewAckStreamMsg([]byte{}))
 	if err != nil {
-		return nil, 0, err
+		cc.logger.Warn("ack frame stream failed", streamAttr(newStream.StreamID()), "err", err)
+		return
 	}
+	cc.addFrameStream(newStream.StreamID(), newStream)
 
-	switch f.(type) {
-	case AckStreamMsg:
-		fmt.Println("reqeust success, new frame stream", newStream.StreamID())
-		cc.frameStreams.Store(newStream.StreamID(), newStream)
-		return newStream, StreamID(newStream.StreamID()), nil
-	default:
-		return nil, 0, fmt.Errorf("not receive Ack")
+	if cc.onIncomingFrameStream != nil {
+		cc.onIncomingFrameStream(newStream)
 	}
 }
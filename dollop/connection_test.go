@@ -0,0 +1,122 @@
+package dollop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestFrameStreamCloseKeepsConn(t *testing.T) {
+	mp := newEchoProtocol(echoRouter{})
+	disconnects := make(chan ConnectionIS, 1)
+	_, addr := startTestServer(t, WithMsgProtocol(mp), WithOnDisconnect(func(conn ConnectionIS) { disconnects <- conn }))
+	c := dialTestClient(t, addr, nil)
+
+	for i := 0; i < 3; i++ {
+		fs, _, err := c.NewFrameStream(mp)
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		if err := fs.WriteMsg(NewBaseMsg([]byte("ping"))); err != nil {
+			t.Fatal(err)
+		}
+		m, err := fs.ReadMsg()
+		if err != nil || string(m.GetData()) != "ping" {
+			t.Fatalf("stream %d: echo = %v, %v", i, m, err)
+		}
+		fs.Close()
+	}
+
+	select {
+	case <-disconnects:
+		t.Fatal("closing a frame stream closed the conn")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// ackConn accepts stream as the stream opened by the peer for a stream request.
+type ackConn struct {
+	quic.Connection
+	stream *memStream
+}
+
+func (c *ackConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	return c.stream, nil
+}
+
+func TestRequestFrameStreamClosesOnBadAck(t *testing.T) {
+	stream := newRepeatStream(NewFrame(NewGoAwayMsg([]byte("bye")).Encode()).Encode())
+	c := &Connection{ctx: context.Background(), qconn: &ackConn{stream: stream}, controlStream: NewFrameStream(&memStream{}), logger: discardLogger}
+	if _, _, err := c.requestFrameStream(); err == nil {
+		t.Fatal("a GoAway answer was taken as an Ack")
+	}
+	if stream.reset != BadAckStreamCode {
+		t.Errorf("stream reset with %d, want BadAckStreamCode", stream.reset)
+	}
+}
+
+// dialLimitedClient connects a client which accepts at most 5 streams opened by the server at once.
+func dialLimitedClient(t *testing.T, addr string) *Client {
+	return dialTestClient(t, addr, func(c *Client) {
+		qc := DefalutQuicConfig.Clone()
+		qc.MaxIncomingStreams = 5
+		c.QuicConfig = qc
+	})
+}
+
+// withinSecond fails t if open does not return in a second, e.g. blocked by the peer's stream limit.
+func withinSecond(t *testing.T, open func() error) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- open() }()
+	if err := recvOrFail(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosedFrameStreamsFreeStreamSlots(t *testing.T) {
+	mp := newEchoProtocol(echoRouter{})
+	_, addr := startTestServer(t, WithMsgProtocol(mp))
+	c := dialLimitedClient(t, addr)
+	for i := 0; i < 12; i++ {
+		withinSecond(t, func() error {
+			fs, _, err := c.NewFrameStream(mp)
+			if err != nil {
+				return err
+			}
+			fs.WriteMsg(NewBaseMsg([]byte("ping")))
+			fs.Close()
+			if _, err := fs.ReadMsg(); err != nil {
+				return err
+			}
+			_, err = fs.ReadMsg() // 服务端在回复后关闭其发送端
+			if err != io.EOF {
+				return fmt.Errorf("read after the reply = %v, want io.EOF", err)
+			}
+			return nil
+		})
+	}
+}
+
+func TestClosedRawStreamsFreeStreamSlots(t *testing.T) {
+	rr := recordRouter{records: make(chan string, 20)}
+	_, addr := startTestServer(t, WithRawRouter(rr))
+	c := dialLimitedClient(t, addr)
+	for i := 0; i < 12; i++ {
+		withinSecond(t, func() error {
+			rs, _, err := c.NewRawStream()
+			if err != nil {
+				return err
+			}
+			rs.Write([]byte("x"))
+			rs.Close()
+			_, err = io.ReadAll(rs)
+			return err
+		})
+		recvOrFail(t, rr.records)
+	}
+}
@@ -1,6 +1,9 @@
 package dollop
 
-import "fmt"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 type ControlMsgType uint8
 
@@ -12,6 +15,10 @@ const (
 	RequestFrameStreamMsgTag ControlMsgType = 0x02
 	AckStreamMsgTag          ControlMsgType = 0x03
 	RejectStreamMsgTag       ControlMsgType = 0x04
+	GoAwayMsgTag             ControlMsgType = 0x05
+	HelloMsgTag              ControlMsgType = 0x06
+	SubscribeMsgTag          ControlMsgType = 0x07
+	UnsubscribeMsgTag        ControlMsgType = 0x08
 )
 
 // client send RequestRawSreamFrame to apply a new stream from server
@@ -36,6 +43,9 @@ func NewRequestRawStreamMsg(data []byte) *RequestRawStreamMsg {
 }
 
 // client send RequestFrameStreamMsg to apply a new framestream from server
+// data : | nameLen [1] | name | versionLen [1] | version | ... | [0 | nameLen [1] | compressor | ...] |,
+// the msg protocol asked for the stream in acceptable versions, empty for the default protocol,
+// followed by the acceptable compressors in preference order if any.
 type RequestFrameStreamMsg struct {
 	data []byte
 }
@@ -52,11 +62,37 @@ func (rfsf RequestFrameStreamMsg) GetData() []byte {
 	return rfsf.data
 }
 
+// Protocol returns the msg protocol asked for the stream, name is empty for the default protocol.
+func (rfsf RequestFrameStreamMsg) Protocol() (name string, versions []string, err error) {
+	data, _, err := splitCompressors(rfsf.data)
+	if err != nil {
+		return "", nil, err
+	}
+	return decodeProtocol(data)
+}
+
+// Compressors returns the names of the compressors acceptable for the stream, in preference order.
+func (rfsf RequestFrameStreamMsg) Compressors() ([]string, error) {
+	_, names, err := splitCompressors(rfsf.data)
+	return names, err
+}
+
 func NewRequestFrameStreamMsg(data []byte) *RequestFrameStreamMsg {
 	return &RequestFrameStreamMsg{data: data}
 }
 
+// BuildRequestFrameStreamMsg asks for a frame stream of the msg protocol name in one of versions, any version if none.
+func BuildRequestFrameStreamMsg(name string, versions ...string) (*RequestFrameStreamMsg, error) {
+	data, err := encodeProtocol(name, versions...)
+	if err != nil {
+		return nil, err
+	}
+	return NewRequestFrameStreamMsg(data), nil
+}
+
 // AckStreamMsg sent from server to client after client sent RequestDawSreamFrame
+// data : | nameLen [1] | name | versionLen [1] | version | [0 | nameLen [1] | compressor] |,
+// the msg protocol bound to a frame stream and the compressor chosen for it if any, empty otherwise.
 type AckStreamMsg struct {
 	data []byte
 }
@@ -73,11 +109,34 @@ func (adsf AckStreamMsg) GetData() []byte {
 	return adsf.data
 }
 
+// Protocol returns the msg protocol bound to the stream, name is empty if the data has none.
+func (adsf AckStreamMsg) Protocol() (name, version string, err error) {
+	data, _, err := splitCompressors(adsf.data)
+	if err != nil {
+		return "", "", err
+	}
+	name, versions, err := decodeProtocol(data)
+	if err != nil || len(versions) == 0 {
+		return name, "", err
+	}
+	return name, versions[0], nil
+}
+
+// Compressor returns the name of the compressor chosen for the stream, empty for none.
+func (adsf AckStreamMsg) Compressor() (string, error) {
+	_, names, err := splitCompressors(adsf.data)
+	if err != nil || len(names) == 0 {
+		return "", err
+	}
+	return names[0], nil
+}
+
 func NewAckStreamMsg(data []byte) *AckStreamMsg {
 	return &AckStreamMsg{data: data}
 }
 
 // RejectRawStreamFrame sent from server to client while occur err
+// data : | reason |
 type RejectStreamMsg struct {
 	data []byte
 }
@@ -98,6 +157,118 @@ func NewRejectStreamMsg(data []byte) *RejectStreamMsg {
 	return &RejectStreamMsg{data: data}
 }
 
+// GoAwayMsg sent from server to client before the server shuts down,
+// the client should stop requesting new streams on this connection
+type GoAwayMsg struct {
+	data []byte
+}
+
+func (gam GoAwayMsg) Type() MsgType {
+	return GoAwayMsgTag
+}
+
+func (gam GoAwayMsg) Encode() []byte {
+	return BuildMsg(GoAwayMsgTag, gam.data)
+}
+
+func (gam GoAwayMsg) GetData() []byte {
+	return gam.data
+}
+
+func NewGoAwayMsg(data []byte) *GoAwayMsg {
+	return &GoAwayMsg{data: data}
+}
+
+// HelloMsg is the first msg on the control stream, sent by the client and answered by the server
+type HelloMsg struct {
+	data []byte
+}
+
+func (hm HelloMsg) Type() MsgType {
+	return HelloMsgTag
+}
+
+func (hm HelloMsg) Encode() []byte {
+	return BuildMsg(HelloMsgTag, hm.data)
+}
+
+func (hm HelloMsg) GetData() []byte {
+	return hm.data
+}
+
+func NewHelloMsg(data []byte) *HelloMsg {
+	return &HelloMsg{data: data}
+}
+
+// SubscribeMsg sent from client to server to subscribe a topic,
+// the published msgs are delivered on the frame stream of StreamID.
+// data : | StreamID [8] | topic |
+type SubscribeMsg struct {
+	data []byte
+}
+
+func (sm SubscribeMsg) Type() MsgType {
+	return SubscribeMsgTag
+}
+
+func (sm SubscribeMsg) Encode() []byte {
+	return BuildMsg(SubscribeMsgTag, sm.data)
+}
+
+func (sm SubscribeMsg) GetData() []byte {
+	return sm.data
+}
+
+func (sm SubscribeMsg) StreamID() (StreamID, error) {
+	if len(sm.data) < 8 {
+		return 0, fmt.Errorf("invalid subscribe msg")
+	}
+	return StreamID(binary.BigEndian.Uint64(sm.data)), nil
+}
+
+func (sm SubscribeMsg) Topic() string {
+	if len(sm.data) < 8 {
+		return ""
+	}
+	return string(sm.data[8:])
+}
+
+func NewSubscribeMsg(data []byte) *SubscribeMsg {
+	return &SubscribeMsg{data: data}
+}
+
+func BuildSubscribeMsg(topic string, id StreamID) *SubscribeMsg {
+	data := make([]byte, 8, 8+len(topic))
+	binary.BigEndian.PutUint64(data, uint64(id))
+	return NewSubscribeMsg(append(data, topic...))
+}
+
+// UnsubscribeMsg sent from client to server to unsubscribe a topic.
+// data : | topic |
+type UnsubscribeMsg struct {
+	data []byte
+}
+
+func (um UnsubscribeMsg) Type() MsgType {
+	return UnsubscribeMsgTag
+}
+
+func (um UnsubscribeMsg) Encode() []byte {
+	return BuildMsg(UnsubscribeMsgTag, um.data)
+}
+
+func (um UnsubscribeMsg) GetData() []byte {
+	return um.data
+}
+
+func (um UnsubscribeMsg) Topic() string {
+	return string(um.data)
+}
+
+func NewUnsubscribeMsg(data []byte) *UnsubscribeMsg {
+	return &UnsubscribeMsg{data: data}
+}
+
 // base Msg protocol
 type ControlMsgProtocol struct {
 	name    string
@@ -114,6 +285,9 @@ func (cmp ControlMsgProtocol) Version() string {
 }
 
 func (cmp ControlMsgProtocol) PaserMsg(f *Frame) MsgI {
+	if len(f.data) < ControlMsgTypeLen {
+		return nil
+	}
 	msgType := f.data[0]
 	dataBuf := f.data[ControlMsgTypeLen:]
 
@@ -126,27 +300,43 @@ func (cmp ControlMsgProtocol) PaserMsg(f *Frame) MsgI {
 		return NewAckStreamMsg(dataBuf)
 	case byte(RejectStreamMsgTag):
 		return NewRejectStreamMsg(dataBuf)
+	case byte(GoAwayMsgTag):
+		return NewGoAwayMsg(dataBuf)
+	case byte(HelloMsgTag):
+		return NewHelloMsg(dataBuf)
+	case byte(SubscribeMsgTag):
+		return NewSubscribeMsg(dataBuf)
+	case byte(UnsubscribeMsgTag):
+		return NewUnsubscribeMsg(dataBuf)
 	}
 	return nil
 }
 
 func (bmp *ControlMsgProtocol) AddM2R(tag MsgType, router FrameRouterI) error {
-	t := tag.(ControlMsgType)
+	t, ok := tag.(ControlMsgType)
+	if !ok {
+		return fmt.Errorf("%w: %T is not ControlMsgType", ErrBadMsgTag, tag)
+	}
 	bmp.M2R[t] = router
 	return nil
 }
 
 func (bmp ControlMsgProtocol) GetRouter(tag MsgType) (FrameRouterI, error) {
-	t := tag.(ControlMsgType)
+	t, ok := tag.(ControlMsgType)
+	if !ok {
+		return nil, ErrRouterNotFound
+	}
 	r := bmp.M2R[t]
 	if r != nil {
 		return bmp.M2R[t], nil
 	}
-	return nil, fmt.Errorf("msg has not a valid router")
+	return nil, ErrRouterNotFound
 }
 
 func ParseControlMsg(frame *Frame) MsgI {
-
+	if len(frame.data) < ControlMsgTypeLen {
+		return nil
+	}
 	msgType := frame.data[0]
 	dataBuf := frame.data[ControlMsgTypeLen:]
 
@@ -159,6 +349,14 @@ func ParseControlMsg(frame *Frame) MsgI {
 		return NewAckStreamMsg(dataBuf)
 	case byte(RejectStreamMsgTag):
 		return NewRejectStreamMsg(dataBuf)
+	case byte(GoAwayMsgTag):
+		return NewGoAwayMsg(dataBuf)
+	case byte(HelloMsgTag):
+		return NewHelloMsg(dataBuf)
+	case byte(SubscribeMsgTag):
+		return NewSubscribeMsg(dataBuf)
+	case byte(UnsubscribeMsgTag):
+		return NewUnsubscribeMsg(dataBuf)
 	}
 	return nil
 }
@@ -169,5 +367,7 @@ var controlMsgProtocol = &ControlMsgProtocol{
 	M2R: map[ControlMsgType]FrameRouterI{
 		RequestRawStreamMsgTag:   &RequestRawStreamRouter{},
 		RequestFrameStreamMsgTag: &RequestFrameStreamRouter{},
+		SubscribeMsgTag:          &SubscribeRouter{},
+		UnsubscribeMsgTag:        &UnsubscribeRouter{},
 	},
 }
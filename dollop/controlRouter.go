@@ -1,7 +1,5 @@
 package dollop
 
-import "fmt"
-
 type RequestFrameStreamRouter struct {
 	BaseFrameRouter
 }
@@ -11,35 +9,53 @@ func (rfsr RequestFrameStreamRouter) Handler(req FrameRequestI) error {
 	if err != nil {
 		return err
 	}
+	sconn := conn.(ConnectionIS) // 实际为server流
 	stream, err := req.GetStream()
 	if err != nil {
 		return err
 	}
-	data, err := req.GetData()
+	m, err := req.GetMsg()
 	if err != nil {
 		return err
 	}
-	fmt.Printf("RequestFrameStreamRouterHandler : stream: %d, request data:%s", stream.StreamID(), data)
+	logger := conn.Logger()
+	logger.Debug("request frame stream", streamAttr(stream.StreamID()), "data", m.GetData())
 
-	// 如果出错，返回拒绝
-	// stream.WriteMsg(NewRejectRawStreamMsg())
+	// client在新流上等待Ack或Reject, 协商失败也需要打开流
+	mp, negotiateErr := sconn.negotiateProtocol(m.(*RequestFrameStreamMsg))
 	newQuicStream, err := conn.OpenStreamSync()
 	if err != nil {
-		fmt.Println(err)
+		logger.Warn("open frame stream failed", "err", err)
+		return err
+	}
+	newStream := conn.newFrameStream(newQuicStream)
+	if negotiateErr != nil {
+		logger.Info("reject frame stream", streamAttr(newStream.StreamID()), "err", negotiateErr)
+		err = newStream.WriteMsg(NewRejectStreamMsg([]byte(negotiateErr.Error())))
+		newStream.Close()
+		return err
 	}
-	newStream := NewFrameStream(newQuicStream)
-	fmt.Println("open new frame stream", newQuicStream.StreamID())
 
-	newStream.BindMsgProtocol(defaultMsgProtocol)
+	newStream.BindMsgProtocol(mp)
 
-	err = newStream.WriteMsg(NewAckStreamMsg([]byte{}))
+	data, _ := encodeProtocol(mp.Name(), mp.Version()) // 注册时已校验
+	cp := sconn.negotiateCompressor(m.(*RequestFrameStreamMsg))
+	if cp != nil {
+		data, _ = appendCompressors(data, cp.Name()) // 名字已由client校验
+	}
+	err = newStream.WriteMsg(NewAckStreamMsg(data))
 	if err != nil {
-		fmt.Println(err)
+		logger.Warn("ack frame stream failed", streamAttr(newStream.StreamID()), "err", err)
 	}
-	fmt.Println("ack to the new frame stream")
+	if cp != nil {
+		// Ack本身不压缩
+		conn.compressStream(newStream, cp)
+	}
+	logger.Debug("frame stream opened", streamAttr(newStream.StreamID()))
 
 	conn.addFrameStream(StreamID(newQuicStream.StreamID()), newStream)
 
+	go sconn.ProcessFrameStream(newStream)
 	return nil
 }
 
@@ -61,27 +77,70 @@ func (rrsr RequestRawStreamRouter) Handler(req FrameRequestI) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("RequestRawStreamRouterHandler : stream: %d, request data:%s", stream.StreamID(), data)
+	logger := conn.Logger()
+	logger.Debug("request raw stream", streamAttr(stream.StreamID()), "data", data)
 
 	// 如果出错，返回拒绝
 	// stream.WriteMsg(NewRejectRawStreamMsg())
 	newQuicStream, err := sconn.OpenStreamSync()
 	if err != nil {
-		fmt.Println(err)
+		logger.Warn("open raw stream failed", "err", err)
+		return err
 	}
-	fmt.Println("open new raw stream", newQuicStream.StreamID())
 
 	newStream := NewRawStream(newQuicStream)
-	newStream.BindRawRouter(&BaseRawRouter{})
 
 	_, err = newStream.Write(NewAckStreamMsg([]byte{}).Encode())
 	if err != nil {
-		fmt.Println(err)
+		logger.Warn("ack raw stream failed", streamAttr(newStream.StreamID()), "err", err)
 	}
-	fmt.Println("ack to the new raw stream")
+	logger.Debug("raw stream opened", streamAttr(newStream.StreamID()))
 
 	conn.addRawStream(StreamID(newQuicStream.StreamID()), newStream)
 
 	go sconn.ProcessRawStream(newStream)
 	return nil
 }
+
+type SubscribeRouter struct {
+	BaseFrameRouter
+}
+
+func (sr SubscribeRouter) Handler(req FrameRequestI) error {
+	conn, err := req.GetConn()
+	if err != nil {
+		return err
+	}
+	sconn := conn.(ConnectionIS) // 实际为server流
+	m, err := req.GetMsg()
+	if err != nil {
+		return err
+	}
+	subMsg := m.(*SubscribeMsg)
+	id, err := subMsg.StreamID()
+	if err != nil {
+		return err
+	}
+	conn.Logger().Debug("subscribe", "topic", subMsg.Topic(), streamAttr(id))
+
+	return sconn.Subscribe(subMsg.Topic(), id)
+}
+
+type UnsubscribeRouter struct {
+	BaseFrameRouter
+}
+
+func (ur UnsubscribeRouter) Handler(req FrameRequestI) error {
+	conn, err := req.GetConn()
+	if err != nil {
+		return err
+	}
+	sconn := conn.(ConnectionIS) // 实际为server流
+	m, err := req.GetMsg()
+	if err != nil {
+		return err
+	}
+
+	sconn.Unsubscribe(m.(*UnsubscribeMsg).Topic())
+	return nil
+}
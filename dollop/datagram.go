@@ -0,0 +1,94 @@
+package dollop
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ErrDatagramNotSupported be returned if datagrams are not negotiated on the conn,
+// both peers must set quic.Config.EnableDatagrams.
+var ErrDatagramNotSupported = errors.New("datagrams are not supported on this conn")
+
+// DatagramChannelI is the third kind of stream: unreliable and unordered msgs sent as quic datagrams.
+// One datagram carries exactly one msg, so there is no frame header.
+type DatagramChannelI interface {
+	BindMsgProtocol(msgP MsgProtocolI) // datagram中msg的解析协议
+	GetMsgProtocol() MsgProtocolI
+	AddRouter(tag MsgType, r DatagramRouterI) error // tag按协议的TagEncoding转换, 在BindMsgProtocol之后调用
+	GetRouter(tag MsgType) (DatagramRouterI, error)
+	ReadMsg() (MsgI, error)
+	WriteMsg(m MsgI) error // msg过大时quic会返回错误, datagram不会分片
+}
+
+type DatagramChannel struct {
+	qconn       quic.Connection
+	msgProtocol MsgProtocolI
+	routers     map[MsgType]DatagramRouterI
+	mu          sync.RWMutex
+}
+
+func NewDatagramChannel(qconn quic.Connection) *DatagramChannel {
+	return &DatagramChannel{qconn: qconn, msgProtocol: defaultMsgProtocol, routers: make(map[MsgType]DatagramRouterI)}
+}
+
+func (dc *DatagramChannel) BindMsgProtocol(msgP MsgProtocolI) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.msgProtocol = msgP
+}
+
+func (dc *DatagramChannel) GetMsgProtocol() MsgProtocolI {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+	return dc.msgProtocol
+}
+
+// AddRouter accepts a tag of any type the TagEncoding of the bound protocol can convert, e.g. an untyped 1
+// for BaseMsgType(1), and returns an error wrapping ErrBadMsgTag otherwise.
+func (dc *DatagramChannel) AddRouter(tag MsgType, r DatagramRouterI) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	t, err := tagEncodingOfProtocol(dc.msgProtocol).Tag(tag)
+	if err != nil {
+		return err
+	}
+	dc.routers[t] = r
+	return nil
+}
+
+func (dc *DatagramChannel) GetRouter(tag MsgType) (DatagramRouterI, error) {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+	t, err := tagEncodingOfProtocol(dc.msgProtocol).Tag(tag)
+	if err != nil {
+		return nil, ErrRouterNotFound
+	}
+	r := dc.routers[t]
+	if r != nil {
+		return r, nil
+	}
+	return nil, ErrRouterNotFound
+}
+
+func (dc *DatagramChannel) ReadMsg() (MsgI, error) {
+	data, err := dc.qconn.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	m := dc.GetMsgProtocol().PaserMsg(NewFrame(data))
+	if m == nil {
+		return nil, ErrUnknownMsg
+	}
+	return m, nil
+}
+
+func (dc *DatagramChannel) WriteMsg(m MsgI) error {
+	data, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	return dc.qconn.SendMessage(data)
+}
@@ -0,0 +1,110 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// errDatagramChannel returns the errors of errs from ReadMsg one by one, then errs[len(errs)-1] forever.
+type errDatagramChannel struct {
+	DatagramChannelI
+	errs  []error
+	reads int
+}
+
+func (c *errDatagramChannel) ReadMsg() (MsgI, error) {
+	err := c.errs[len(c.errs)-1]
+	if c.reads < len(c.errs) {
+		err = c.errs[c.reads]
+	}
+	c.reads++
+	return nil, err
+}
+
+func TestProcessDatagramsReturnsOnReceiveError(t *testing.T) {
+	sc := NewServerConnection(context.Background(), nil)
+	channel := &errDatagramChannel{errs: []error{ErrUnknownMsg, ErrUnknownMsg, errors.New("conn closed")}}
+	done := make(chan struct{})
+	go func() {
+		sc.ProcessDatagrams(channel)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ProcessDatagrams kept reading after a receive error")
+	}
+	if channel.reads != 3 {
+		t.Errorf("reads = %d, want 3: unknown msgs are skipped, the receive error ends the loop", channel.reads)
+	}
+}
+
+// datagramRecorder passes the data of the datagrams it handles to got.
+type datagramRecorder struct {
+	BaseDatagramRouter
+	got chan string
+}
+
+func (dr datagramRecorder) Handler(req DatagramRequestI) error {
+	m, err := req.GetMsg()
+	if err != nil {
+		return err
+	}
+	dr.got <- string(m.GetData())
+	return nil
+}
+
+func TestDatagramRouterTags(t *testing.T) {
+	dc := NewDatagramChannel(nil)
+	dc.BindMsgProtocol(NewBaseMsgProtocol("t", "v1"))
+	r := datagramRecorder{}
+	if err := dc.AddRouter(1, r); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := dc.GetRouter(BaseMsgType(1)); err != nil || got != r {
+		t.Fatalf("GetRouter(BaseMsgType(1)) = %v, %v, want the router added by an untyped 1", got, err)
+	}
+	if _, err := dc.GetRouter(uint16(1)); err != nil {
+		t.Fatalf("GetRouter(uint16(1)) = %v", err)
+	}
+	for _, tag := range []MsgType{"route", 256, -1, nil} {
+		if err := dc.AddRouter(tag, r); !errors.Is(err, ErrBadMsgTag) {
+			t.Errorf("AddRouter(%v) = %v, want ErrBadMsgTag", tag, err)
+		}
+	}
+
+	st, _ := testTLS(t)
+	mp := NewBaseMsgProtocol("t", "v1")
+	if _, err := NewServer("test", WithTlsConfig(st), WithDatagramRouter("route", r), WithDatagrams(mp)); !errors.Is(err, ErrBadMsgTag) {
+		t.Fatalf("NewServer with a bad datagram tag = %v, want ErrBadMsgTag", err)
+	}
+}
+
+func TestDatagramRoutedByUntypedTag(t *testing.T) {
+	mp := NewBaseMsgProtocol("t", "v1")
+	r := datagramRecorder{got: make(chan string, 1)}
+	_, addr := startTestServer(t, WithDatagramRouter(int(BaseMsgTag), r), WithDatagrams(mp))
+	c := dialTestClient(t, addr, func(c *Client) { c.EnableDatagrams(mp) })
+	channel, err := c.GetDatagramChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// datagram可能丢失, 重发直到router收到
+	for i := 0; i < 20; i++ {
+		if err := channel.WriteMsg(NewBaseMsg([]byte("datagram"))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-r.got:
+			if got != "datagram" {
+				t.Fatalf("router got %q", got)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("the router added by an untyped tag got no datagram")
+}
@@ -0,0 +1,143 @@
+package dollop
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrRequestDropped is passed to the ErrorHandler for a request which is not handled,
+// because its conn is shutting down or the WorkerPool was stopped before running it.
+var ErrRequestDropped = errors.New("request dropped")
+
+// DispatchMode decides how the handlers of the msgs read from raw/frame streams and datagrams are executed.
+// Control stream requests are always handled concurrently.
+type DispatchMode uint8
+
+const (
+	// DispatchConcurrent runs every msg in its own goroutine, msgs of a stream may be handled out of order.
+	DispatchConcurrent DispatchMode = iota
+	// DispatchSerial runs the msgs of a stream one by one in the reading goroutine,
+	// the stream is not read until the handler returns.
+	DispatchSerial
+	// DispatchPool runs the msgs on the server's WorkerPool, the msgs of a stream always go to the same worker
+	// so they are handled in order. A full queue blocks the reading of the stream.
+	DispatchPool
+)
+
+const (
+	DefaultPoolWorkers   int = 64
+	DefaultPoolQueueSize int = 128 // 每个worker的队列长度
+)
+
+// WorkerPool runs tasks on a fixed number of workers, each worker has a bounded queue.
+type WorkerPool struct {
+	queues  []chan poolTask
+	quit    chan struct{}
+	mu      sync.RWMutex // Stop之后不再入队
+	stopped bool
+}
+
+type poolTask struct {
+	run  func()
+	drop func() // 任务被Stop丢弃时调用, 可为nil
+}
+
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	if workers <= 0 {
+		workers = DefaultPoolWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultPoolQueueSize
+	}
+	p := &WorkerPool{queues: make([]chan poolTask, workers), quit: make(chan struct{})}
+	for i := range p.queues {
+		p.queues[i] = make(chan poolTask, queueSize)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *WorkerPool) work(queue chan poolTask) {
+	for {
+		select {
+		case <-p.quit:
+			p.drain(queue)
+			return
+		case task := <-queue:
+			select {
+			case <-p.quit: // Stop优先, 已停止时不再执行排队的任务
+				task.dropped()
+				p.drain(queue)
+				return
+			default:
+			}
+			task.run()
+		}
+	}
+}
+
+// drain drops the tasks left in queue, nothing is queued after Stop.
+func (p *WorkerPool) drain(queue chan poolTask) {
+	for {
+		select {
+		case task := <-queue:
+			task.dropped()
+		default:
+			return
+		}
+	}
+}
+
+func (t poolTask) dropped() {
+	if t.drop != nil {
+		t.drop()
+	}
+}
+
+// Submit queues task on the worker picked by key, tasks of the same key run in submission order.
+// It blocks while the queue is full, and returns false without queuing if cancel or the pool is closed first.
+// drop, if not nil, is called instead of task if the pool is stopped while task is queued.
+func (p *WorkerPool) Submit(key uint64, task func(), drop func(), cancel <-chan struct{}) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return false
+	}
+	queue := p.queues[mixKey(key)%uint64(len(p.queues))]
+	t := poolTask{run: task, drop: drop}
+	select {
+	case queue <- t:
+		return true
+	default:
+	}
+
+	select {
+	case queue <- t:
+		return true
+	case <-cancel:
+	case <-p.quit:
+	}
+	return false
+}
+
+// Stop makes the workers exit after their current task, the queued tasks are not run but dropped.
+func (p *WorkerPool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.quit)
+	}
+}
+
+// mixKey spreads nearby keys, e.g. stream ids of one conn, over the workers.
+func mixKey(key uint64) uint64 {
+	key ^= key >> 33
+	key *= 0xff51afd7ed558ccd
+	key ^= key >> 33
+	return key
+}
+
+func dispatchKey(conn ConnID, stream StreamID) uint64 {
+	return uint64(conn)<<32 ^ uint64(stream)
+}
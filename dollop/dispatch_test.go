@@ -0,0 +1,208 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolStopDropsQueued(t *testing.T) {
+	p := NewWorkerPool(1, 8)
+	running := make(chan struct{})
+	release := make(chan struct{})
+	p.Submit(0, func() {
+		close(running)
+		<-release
+	}, nil, nil)
+	<-running
+
+	var ran, dropped int32
+	for i := 0; i < 5; i++ {
+		ok := p.Submit(0, func() { atomic.AddInt32(&ran, 1) }, func() { atomic.AddInt32(&dropped, 1) }, nil)
+		if !ok {
+			t.Fatal("Submit failed before Stop")
+		}
+	}
+	p.Stop()
+	close(release)
+	for i := 0; i < 100 && atomic.LoadInt32(&dropped) < 5; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ran, dropped := atomic.LoadInt32(&ran), atomic.LoadInt32(&dropped); ran != 0 || dropped != 5 {
+		t.Errorf("after Stop ran %d, dropped %d, want 0, 5", ran, dropped)
+	}
+	if p.Submit(0, func() {}, nil, nil) {
+		t.Error("Submit succeeded after Stop")
+	}
+	p.Stop()
+}
+
+// sleepRouter handles every msg in d without replying.
+type sleepRouter struct {
+	BaseFrameRouter
+	d time.Duration
+}
+
+func (sr sleepRouter) Handler(req FrameRequestI) error {
+	time.Sleep(sr.d)
+	return nil
+}
+
+func TestShutdownUnderTraffic(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchConcurrent, DispatchPool} {
+		var dropped int32
+		mp := newEchoProtocol(sleepRouter{d: 20 * time.Millisecond})
+		opts := []WithConfig{WithMsgProtocol(mp), WithDispatchMode(mode), WithErrorHandler(func(req RequestI, err error) {
+			if errors.Is(err, ErrRequestDropped) {
+				atomic.AddInt32(&dropped, 1)
+			}
+		})}
+		if mode == DispatchPool {
+			// WithWorkerPool 会切换到 DispatchPool, 只在该模式下传入
+			opts = append(opts, WithWorkerPool(2, 4))
+		}
+		s, addr := startTestServer(t, opts...)
+		if s.dispatchMode != mode {
+			t.Fatalf("dispatch mode = %d, want %d", s.dispatchMode, mode)
+		}
+		c := dialTestClient(t, addr, nil)
+		fs, _, err := c.NewFrameStream(mp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for fs.WriteMsg(NewBaseMsg([]byte("tick"))) == nil {
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
+		err = s.Shutdown(ctx)
+		cancel()
+		if err != nil || time.Since(start) > 2*time.Second {
+			t.Errorf("mode %d: Shutdown = %v after %v, the drain must finish under traffic", mode, err, time.Since(start))
+		}
+		if atomic.LoadInt32(&dropped) == 0 {
+			t.Errorf("mode %d: no msg read during the drain was dropped", mode)
+		}
+	}
+}
+
+// orderRouter passes "streamID:data" of the msgs it handles to got, after a jittered delay
+// which reorders the msgs handled concurrently.
+type orderRouter struct {
+	BaseFrameRouter
+	got chan string
+}
+
+func (or orderRouter) Handler(req FrameRequestI) error {
+	m, err := req.GetMsg()
+	if err != nil {
+		return err
+	}
+	stream, err := req.GetStream()
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+	or.got <- fmt.Sprintf("%d:%s", stream.StreamID(), m.GetData())
+	return nil
+}
+
+func TestDispatchKeepsStreamOrder(t *testing.T) {
+	const streams, msgs = 3, 50
+	for _, mode := range []DispatchMode{DispatchSerial, DispatchPool} {
+		r := orderRouter{got: make(chan string, streams*msgs)}
+		mp := newEchoProtocol(r)
+		opts := []WithConfig{WithMsgProtocol(mp), WithDispatchMode(mode)}
+		if mode == DispatchPool {
+			opts = append(opts, WithWorkerPool(2, 4))
+		}
+		_, addr := startTestServer(t, opts...)
+		c := dialTestClient(t, addr, nil)
+
+		for i := 0; i < streams; i++ {
+			fs, _, err := c.NewFrameStream(mp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				for j := 0; j < msgs; j++ {
+					fs.WriteMsg(NewBaseMsg([]byte(strconv.Itoa(j))))
+				}
+			}()
+		}
+
+		next := make(map[string]int) // 每条流下一个应收到的序号
+		for i := 0; i < streams*msgs; i++ {
+			var got string
+			select {
+			case got = <-r.got:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("mode %d: got %d of %d msgs", mode, i, streams*msgs)
+			}
+			id, seq, _ := strings.Cut(got, ":")
+			if want := strconv.Itoa(next[id]); seq != want {
+				t.Fatalf("mode %d: stream %s handled msg %s, want %s", mode, id, seq, want)
+			}
+			next[id]++
+		}
+		c.Close()
+	}
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	p := NewWorkerPool(1, 2)
+	defer p.Stop()
+	running := make(chan struct{})
+	release := make(chan struct{})
+	p.Submit(0, func() {
+		close(running)
+		<-release
+	}, nil, nil)
+	<-running
+	for i := 0; i < 2; i++ {
+		if !p.Submit(0, func() {}, nil, nil) {
+			t.Fatal("Submit failed with room in the queue")
+		}
+	}
+
+	// 队列已满, Submit阻塞直到worker取走任务
+	submitted := make(chan bool, 1)
+	go func() { submitted <- p.Submit(0, func() {}, nil, nil) }()
+	select {
+	case <-submitted:
+		t.Fatal("Submit returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if !recvOrFail(t, submitted) {
+		t.Fatal("blocked Submit failed after the queue drained")
+	}
+
+	// cancel结束阻塞的Submit, 任务不入队
+	running = make(chan struct{})
+	release = make(chan struct{})
+	p.Submit(0, func() {
+		close(running)
+		<-release
+	}, nil, nil)
+	<-running
+	p.Submit(0, func() {}, nil, nil)
+	p.Submit(0, func() {}, nil, nil)
+	cancel := make(chan struct{})
+	go func() { submitted <- p.Submit(0, func() { t.Error("canceled task ran") }, nil, cancel) }()
+	close(cancel)
+	if recvOrFail(t, submitted) {
+		t.Fatal("canceled Submit queued its task")
+	}
+	close(release)
+}
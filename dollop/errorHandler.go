@@ -0,0 +1,70 @@
+package dollop
+
+import (
+	"errors"
+
+	"github.com/quic-go/quic-go"
+)
+
+// HandlerErrorStreamCode is a stream error code for CloseStreamOnError, the peer sees it as a quic.StreamError.
+const HandlerErrorStreamCode quic.StreamErrorCode = 0x01
+
+// RemoteError is the error replied by the peer's handler through ReplyError,
+// returned by RPCStream.Call and FrameStream.ReadMsg. The stream is still usable.
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote handler error: " + e.Msg
+}
+
+// ErrorHandler receives the error returned by a handler, or the panic recovered from it as a *PanicError.
+// req is a FrameRequestI, RawRequestI or DatagramRequestI, which carries the conn and the stream.
+type ErrorHandler func(req RequestI, err error)
+
+// LogError is the default ErrorHandler, it logs err with the logger of the conn.
+func LogError(req RequestI, err error) {
+	conn, _ := req.GetConn()
+	logger := conn.Logger()
+	switch r := req.(type) {
+	case FrameRequestI:
+		stream, _ := r.GetStream()
+		m, _ := r.GetMsg()
+		logger = logger.With(streamAttr(stream.StreamID()), msgTypeAttr(m))
+	case RawRequestI:
+		stream, _ := r.GetStream()
+		logger = logger.With(streamAttr(stream.StreamID()))
+	}
+
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		logger.Error("handler panic", "err", err, "stack", string(pe.Stack))
+		return
+	}
+	logger.Warn("handler failed", "err", err)
+}
+
+// ReplyError logs err and replies it to the peer of a frame request, as the reply of the call if it is one.
+// Errors of raw and datagram requests are only logged.
+func ReplyError(req RequestI, err error) {
+	LogError(req, err)
+	if r, ok := req.(FrameRequestI); ok {
+		r.ReplyError(err)
+	}
+}
+
+// CloseStreamOnError returns an ErrorHandler which logs err and resets the stream of the request with code.
+func CloseStreamOnError(code quic.StreamErrorCode) ErrorHandler {
+	return func(req RequestI, err error) {
+		LogError(req, err)
+		switch r := req.(type) {
+		case FrameRequestI:
+			stream, _ := r.GetStream()
+			stream.CloseWithError(code)
+		case RawRequestI:
+			stream, _ := r.GetStream()
+			stream.CloseWithError(code)
+		}
+	}
+}
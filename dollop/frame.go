@@ -1,33 +1,180 @@
 package dollop
 
 import (
-	"bytes"
 	"encoding/binary"
 )
 
 // Type represents the type of frame.
 const FrameLen int = 4 // int32
 
+// FrameFlagsLen is the byte len of the frame flags : uint8 -> 1
+const FrameFlagsLen int = 1
+
+// CallIDLen is the byte len of the call id of a rpc frame : uint32 -> 4
+const CallIDLen int = 4
+
+// TraceMetaLen is the byte len of the trace metadata of a frame : | traceID [16] | spanID [8] | traceFlags [1] |
+const TraceMetaLen int = 16 + 8 + 1
+
+// maxFrameHeaderLen is the byte len of the largest frame header: len, flags, call id and trace metadata.
+const maxFrameHeaderLen int = FrameLen + FrameFlagsLen + CallIDLen + TraceMetaLen
+
+// FrameFlag marks which optional headers follow the flags of a frame.
+type FrameFlag uint8
+
+const (
+	FrameFlagCall       FrameFlag = 1 << 0 // rpc request, followed by the call id
+	FrameFlagReply      FrameFlag = 1 << 1 // rpc response, followed by the call id of the request
+	FrameFlagTrace      FrameFlag = 1 << 2 // followed by the trace metadata, after the call id if any
+	FrameFlagError      FrameFlag = 1 << 3 // the data is an error text sent by FrameRequest.ReplyError instead of a msg
+	FrameFlagChunk      FrameFlag = 1 << 4 // a frame of a chunked msg, the first one carries the msg and the others its body
+	FrameFlagFinal      FrameFlag = 1 << 5 // the last frame of a chunked msg
+	FrameFlagCompressed FrameFlag = 1 << 6 // the data is compressed by the compressor negotiated for the stream
+)
+
 // 帧在本框架是固定的存在，帧流的最小单元永远是Frame
 type Frame struct {
-	len  int // how long this frame
-	data []byte
+	len    int // how long this frame's data
+	flags  FrameFlag
+	callID uint32       // valid if flags has FrameFlagCall or FrameFlagReply
+	trace  *SpanContext // not nil if flags has FrameFlagTrace, 指针使未追踪的帧保持较小的分配
+	data   []byte
+	buf    *[]byte // data所在的池化buffer, 由Release归还
 }
 
 func (f Frame) GetData() []byte {
 	return f.data
 }
 
+func (f Frame) Flags() FrameFlag {
+	return f.flags
+}
+
+// CallID returns the call id of a rpc frame, ok is false if the frame is not a rpc frame.
+func (f Frame) CallID() (id uint32, ok bool) {
+	return f.callID, f.hasCallID()
+}
+
+// SpanContext returns the trace metadata of the frame, ok is false if the frame carries none.
+func (f Frame) SpanContext() (sc SpanContext, ok bool) {
+	if f.trace == nil || f.flags&FrameFlagTrace == 0 {
+		return SpanContext{}, false
+	}
+	return *f.trace, true
+}
+
+// setTrace attaches sc to the frame if it is valid.
+func (f *Frame) setTrace(sc SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	f.flags |= FrameFlagTrace
+	f.trace = &sc
+}
+
+func (f Frame) hasCallID() bool {
+	return f.flags&(FrameFlagCall|FrameFlagReply) != 0
+}
+
+// bodyLen is the len announced in the frame header: flags, optional headers and data.
+func (f Frame) bodyLen() int {
+	n := FrameFlagsLen + f.len
+	if f.hasCallID() {
+		n += CallIDLen
+	}
+	if f.flags&FrameFlagTrace != 0 {
+		n += TraceMetaLen
+	}
+	return n
+}
+
+// putHeader writes the header of the frame, everything before the data, into dst and returns its len.
+// dst must have maxFrameHeaderLen bytes at least.
+//
+//	| len [FrameLen] | flags [FrameFlagsLen] | callID [CallIDLen], rpc only | trace [TraceMetaLen], optional | Msg |
+func (f *Frame) putHeader(dst []byte) int {
+	binary.BigEndian.PutUint32(dst, uint32(f.bodyLen()))
+	dst[FrameLen] = byte(f.flags)
+	n := FrameLen + FrameFlagsLen
+	if f.hasCallID() {
+		binary.BigEndian.PutUint32(dst[n:], f.callID)
+		n += CallIDLen
+	}
+	if f.flags&FrameFlagTrace != 0 {
+		n += copy(dst[n:], f.trace.TraceID[:])
+		n += copy(dst[n:], f.trace.SpanID[:])
+		dst[n] = byte(f.trace.TraceFlags)
+		n++
+	}
+	return n
+}
+
 func (f Frame) Encode() []byte {
-	frameBuf := bytes.NewBuffer([]byte{})
+	var header [maxFrameHeaderLen]byte
+	n := f.putHeader(header[:])
+	frameBuf := make([]byte, n+len(f.data))
+	copy(frameBuf, header[:n])
+	copy(frameBuf[n:], f.data)
+	return frameBuf
+}
 
-	binary.Write(frameBuf, binary.BigEndian, uint32(f.len))
-	binary.Write(frameBuf, binary.BigEndian, f.data)
+// Release gives the pooled buffer of a frame read by ReadPooledMsg back to the pool,
+// the data of the frame and of the msg parsed from it must not be used after it.
+// It does nothing for other frames.
+func (f *Frame) Release() {
+	if f.buf != nil {
+		putBuf(f.buf)
+		f.buf, f.data = nil, nil
+	}
+}
 
-	//  | len [FrameLen] | Msg |
-	return frameBuf.Bytes()
+// decodeFrame parses the frame body, which is everything after the len header.
+func decodeFrame(body []byte) (*Frame, error) {
+	f := &Frame{}
+	err := decodeFrameInto(f, body)
+	if err != nil {
+		return &Frame{}, err
+	}
+	return f, nil
+}
+
+// decodeFrameInto parses the frame body into f, overwriting all its fields.
+func decodeFrameInto(f *Frame, body []byte) error {
+	*f = Frame{}
+	if len(body) < FrameFlagsLen {
+		return ErrShortFrame
+	}
+	f.flags = FrameFlag(body[0])
+	body = body[FrameFlagsLen:]
+
+	if f.hasCallID() {
+		if len(body) < CallIDLen {
+			return ErrShortFrame
+		}
+		f.callID = binary.BigEndian.Uint32(body)
+		body = body[CallIDLen:]
+	}
+
+	if f.flags&FrameFlagTrace != 0 {
+		if len(body) < TraceMetaLen {
+			return ErrShortFrame
+		}
+		f.trace = &SpanContext{Remote: true}
+		copy(f.trace.TraceID[:], body[:16])
+		copy(f.trace.SpanID[:], body[16:24])
+		f.trace.TraceFlags = TraceFlags(body[24])
+		body = body[TraceMetaLen:]
+	}
+
+	f.len = len(body)
+	f.data = body
+	return nil
 }
 
 func NewFrame(data []byte) *Frame {
 	return &Frame{len: len(data), data: data}
 }
+
+func newRPCFrame(flags FrameFlag, callID uint32, data []byte) *Frame {
+	return &Frame{len: len(data), flags: flags, callID: callID, data: data}
+}
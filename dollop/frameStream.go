@@ -1,106 +1,375 @@
 package dollop
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/quic-go/quic-go"
 )
 
-// ErrStreamNil be returned if FrameStream underlying stream is nil.
-var ErrFrameStreamNil = errors.New("FrameStream's stream is nil")
+var (
+	// ErrStreamNil be returned if FrameStream underlying stream is nil.
+	ErrFrameStreamNil = errors.New("FrameStream's stream is nil")
+	// ErrFrameTooLarge be returned if a frame is larger than the max frame size of the stream.
+	ErrFrameTooLarge = errors.New("frame is too large")
+	// ErrShortFrame be returned if the stream ends in the middle of a frame.
+	ErrShortFrame = errors.New("short frame")
+	// ErrMsgProtocolNil be returned if no MsgProtocol is bound to the FrameStream.
+	ErrMsgProtocolNil = errors.New("FrameStream's msg protocol is nil")
+)
+
+// DefaultMaxFrameSize is the max frame size used by a new FrameStream, 16 MiB.
+const DefaultMaxFrameSize int = 16 * 1024 * 1024
+
+// smallFrameLen is the max data len of a frame written by one stream.Write together with its header,
+// the data of larger frames is written after the header without being copied.
+const smallFrameLen int = 1024
 
 type FrameStreamI interface {
 	StreamID() StreamID
 	readFrame() (*Frame, error)
+	readPooledFrame() (*Frame, error) // 帧的数据位于池化buffer, 使用后由Frame.Release归还
 	writeFrame(f *Frame) error
 	BindMsgProtocol(msgP MsgProtocolI) // 协议绑定机制，将协议绑定到帧流上；子流级别增加新协议支持
+	GetMsgProtocol() MsgProtocolI
 	GetRouter(tag MsgType) (FrameRouterI, error)
-	ReadMsg() (MsgI, error) // 根据绑定的消息协议，完成帧到msg一步到位解析
-	WriteMsg(m MsgI) error  // 根据绑定的消息协议，将msg包装成帧发送
+	decodeMsg(f *Frame) (MsgI, error)              // 根据绑定的消息协议，将帧解析为msg
+	SetMaxFrameSize(size int)                      // 限制对端可声明的帧长度, <=0 表示不限制
+	ReadMsg() (MsgI, error)                        // 根据绑定的消息协议，完成帧到msg一步到位解析
+	WriteMsg(m MsgI) error                         // 根据绑定的消息协议，将msg包装成帧发送
+	WriteMsgCtx(ctx context.Context, m MsgI) error // 同WriteMsg, 并在帧中携带ctx的trace上下文
+	WriteMsgFrom(m MsgI, body io.Reader) error     // 分块发送m及从body读取的数据, 适用于大的msg
+	ReadMsgBody() (MsgI, io.Reader, error)         // 同ReadMsg, 分块msg的body由返回的io.Reader读取
+	ReadPooledMsg() (MsgI, *Frame, error)          // 同ReadMsg, msg使用完后调用Frame.Release归还buffer
+	Compressor() CompressorI                       // 打开流时协商的压缩, nil为不压缩
 	Close()
+	CloseWithError(code quic.StreamErrorCode) // 以错误码重置流, 对端读写得到quic.StreamError
+	cancelRead(code quic.StreamErrorCode)     // 只停止读取, 发送端由Close结束
 }
 
 // FrameStream is the ReadWriter that goroutinue read write safely.
 type FrameStream struct {
-	stream      quic.Stream
-	msgProtocol MsgProtocolI
-	mu          sync.Mutex
+	stream       atomic.Pointer[quic.Stream] // 重连后被替换, 读写路径上无锁读取
+	msgProtocol  MsgProtocolI
+	maxFrameSize int
+	mu           sync.Mutex
+	smu          sync.RWMutex // 保护closed和rebound
+	closed       bool
+	rebound      chan struct{}                           // rebind时关闭, 由smu保护
+	body         *chunkReader                            // ReadMsgBody返回的未读完的body
+	requested    []MsgProtocolI                          // 打开流时请求的协议, 重连后再次请求
+	compressor   CompressorI                             // nil为不压缩
+	compressMin  int                                     // 数据不小于该长度的帧才压缩
+	lenBuf       [FrameLen]byte                          // 读帧长度, 同一时刻只有一个读者
+	readBuf      Frame                                   // ReadMsg复用的帧, 省去每次读的分配
+	writeBuf     [maxFrameHeaderLen + smallFrameLen]byte // 写帧头和小帧, 由mu保护
 }
 
 // NewFrameStream creates a new FrameStream.
 func NewFrameStream(s quic.Stream) *FrameStream {
-	return &FrameStream{stream: s}
+	fs := &FrameStream{maxFrameSize: DefaultMaxFrameSize}
+	fs.stream.Store(&s)
+	return fs
 }
 
 func (fs *FrameStream) StreamID() StreamID {
-	return StreamID(fs.stream.StreamID())
+	return StreamID(fs.getStream().StreamID())
+}
+
+func (fs *FrameStream) getStream() quic.Stream {
+	return *fs.stream.Load()
+}
+
+// rebind replaces the underlying stream after the client reconnected,
+// so the FrameStream held by the application keeps working.
+func (fs *FrameStream) rebind(s quic.Stream) {
+	fs.smu.Lock()
+	defer fs.smu.Unlock()
+	fs.stream.Store(&s)
+	if fs.rebound != nil {
+		close(fs.rebound)
+		fs.rebound = nil
+	}
+}
+
+// reboundChan returns a chan closed by the next rebind.
+func (fs *FrameStream) reboundChan() <-chan struct{} {
+	fs.smu.Lock()
+	defer fs.smu.Unlock()
+	if fs.rebound == nil {
+		fs.rebound = make(chan struct{})
+	}
+	return fs.rebound
 }
 
-// Frame :  | len:FrameLen | Msg |
-func readFrame(stream io.Reader) (*Frame, error) {
-	lenBuf := make([]byte, FrameLen)
-	_, err := stream.Read(lenBuf)
+func (fs *FrameStream) isClosed() bool {
+	fs.smu.RLock()
+	defer fs.smu.RUnlock()
+	return fs.closed
+}
+
+// Frame :  | len:FrameLen | flags | [callID] | [trace] | Msg |
+// readFrame reads exactly one frame, a frame larger than maxSize is rejected
+// before its payload is allocated. The payload is taken from the buffer pool if pooled.
+func readFrame(stream io.Reader, lenBuf []byte, maxSize int, pooled bool) (*Frame, error) {
+	f := &Frame{}
+	err := readFrameInto(f, stream, lenBuf, maxSize, pooled)
 	if err != nil {
 		return &Frame{}, err
 	}
+	return f, nil
+}
+
+// readFrameInto reads exactly one frame into f like readFrame, f is left empty on error.
+func readFrameInto(f *Frame, stream io.Reader, lenBuf []byte, maxSize int, pooled bool) error {
+	_, err := io.ReadFull(stream, lenBuf)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrShortFrame
+		}
+		return err
+	}
 
 	bufferLen := binary.BigEndian.Uint32(lenBuf)
+	if maxSize > 0 && uint64(bufferLen) > uint64(maxSize) {
+		return fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, bufferLen, maxSize)
+	}
 
-	frameBuf := make([]byte, bufferLen)
-	_, err = stream.Read(frameBuf)
-	if err != nil {
-		return &Frame{}, err
+	var buf *[]byte
+	var frameBuf []byte
+	if pooled {
+		buf = getBuf(int(bufferLen))
+		frameBuf = *buf
+	} else {
+		frameBuf = make([]byte, bufferLen)
+	}
+	_, err = io.ReadFull(stream, frameBuf)
+	if err == nil {
+		//  Frame
+		err = decodeFrameInto(f, frameBuf)
+		if err == nil {
+			f.buf = buf
+			return nil
+		}
 	}
-	//  Frame
-	return NewFrame(frameBuf), nil
+	*f = Frame{}
+	if buf != nil {
+		putBuf(buf)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrShortFrame
+	}
+	return err
 }
 
 // ReadFrame reads next frame from underlying stream.
 func (fs *FrameStream) readFrame() (*Frame, error) {
-	if fs.stream == nil {
+	f := &Frame{}
+	err := fs.readFrameInto(f)
+	return f, err
+}
+
+// readFrameInto reads next frame into f, ReadMsg passes its reused frame to save the allocation.
+func (fs *FrameStream) readFrameInto(f *Frame) error {
+	stream := fs.getStream()
+	if stream == nil {
+		return ErrFrameStreamNil
+	}
+	err := readFrameInto(f, stream, fs.lenBuf[:], fs.maxFrameSize, false)
+	if err == nil && f.flags&FrameFlagCompressed != 0 {
+		err = decompressFrame(f, fs.compressor, fs.maxFrameSize)
+	}
+	return err
+}
+
+func (fs *FrameStream) readPooledFrame() (*Frame, error) {
+	stream := fs.getStream()
+	if stream == nil {
 		return &Frame{}, ErrFrameStreamNil
 	}
-	return readFrame(fs.stream)
+	f, err := readFrame(stream, fs.lenBuf[:], fs.maxFrameSize, true)
+	if err == nil && f.flags&FrameFlagCompressed != 0 {
+		err = decompressFrame(f, fs.compressor, fs.maxFrameSize)
+	}
+	return f, err
 }
 
 // WriteFrame writes a frame into underlying stream.
 func (fs *FrameStream) writeFrame(f *Frame) error {
-	if fs.stream == nil {
+	stream := fs.getStream()
+	if stream == nil {
 		return ErrFrameStreamNil
 	}
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	return fs.writeFrameLocked(stream, f)
+}
 
-	_, err := fs.stream.Write(f.Encode())
+// writeFrameLocked writes f like writeFrame, the caller holds fs.mu.
+// The header and the data are written as two buffers, without joining them into a new slice.
+func (fs *FrameStream) writeFrameLocked(stream quic.Stream, f *Frame) error {
+	if fs.compressor != nil && len(f.data) >= fs.compressMin {
+		f = compressFrame(f, fs.compressor)
+	}
+	if fs.maxFrameSize > 0 && f.bodyLen() > fs.maxFrameSize {
+		return fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, f.bodyLen(), fs.maxFrameSize)
+	}
+	n := f.putHeader(fs.writeBuf[:])
+	if len(f.data) <= smallFrameLen {
+		// 小帧拷贝到帧头之后, 一次写入
+		n += copy(fs.writeBuf[n:], f.data)
+		_, err := stream.Write(fs.writeBuf[:n])
+		return err
+	}
+	_, err := stream.Write(fs.writeBuf[:n])
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(f.data)
 	return err
 }
 
 func (fs *FrameStream) Close() {
-	fs.stream.Close()
+	fs.smu.Lock()
+	fs.closed = true
+	fs.smu.Unlock()
+	fs.getStream().Close()
+}
+
+func (fs *FrameStream) CloseWithError(code quic.StreamErrorCode) {
+	fs.smu.Lock()
+	fs.closed = true
+	fs.smu.Unlock()
+	stream := fs.getStream()
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
+}
+
+func (fs *FrameStream) cancelRead(code quic.StreamErrorCode) {
+	fs.getStream().CancelRead(code)
 }
 
 func (fs *FrameStream) BindMsgProtocol(msgP MsgProtocolI) {
 	fs.msgProtocol = msgP
 }
 
+func (fs *FrameStream) GetMsgProtocol() MsgProtocolI {
+	return fs.msgProtocol
+}
+
+// setCompression compresses the frames whose data is at least minSize by c, nil for none.
+// The peer must decompress by the same compressor, they are negotiated when the stream is opened.
+func (fs *FrameStream) setCompression(c CompressorI, minSize int) {
+	if minSize <= 0 {
+		minSize = DefaultCompressMinSize
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.compressor = c
+	fs.compressMin = minSize
+}
+
+func (fs *FrameStream) Compressor() CompressorI {
+	return fs.compressor
+}
+
+func (fs *FrameStream) SetMaxFrameSize(size int) {
+	fs.maxFrameSize = size
+}
+
 func (fs *FrameStream) GetRouter(tag MsgType) (FrameRouterI, error) {
 	return fs.msgProtocol.GetRouter(tag)
 }
 
+func (fs *FrameStream) decodeMsg(f *Frame) (MsgI, error) {
+	if fs.msgProtocol == nil {
+		return nil, ErrMsgProtocolNil
+	}
+	m := fs.msgProtocol.PaserMsg(f)
+	if m == nil {
+		return nil, ErrUnknownMsg
+	}
+	return m, nil
+}
+
+// ReadMsg reads the next msg, a *RemoteError is returned if the peer replied an error by ReplyError.
+// The body of a chunked msg is skipped, read it by ReadMsgBody.
 func (fs *FrameStream) ReadMsg() (MsgI, error) {
-	f, err := fs.readFrame()
+	err := fs.skipBody()
 	if err != nil {
 		return nil, err
 	}
+	f := &fs.readBuf
+	err = fs.readFrameInto(f)
+	if err != nil {
+		return nil, err
+	}
+	if f.flags&FrameFlagError != 0 {
+		return nil, &RemoteError{Msg: string(f.data)}
+	}
+	if f.flags&FrameFlagChunk != 0 {
+		fs.body = &chunkReader{fs: fs, eof: f.flags&FrameFlagFinal != 0}
+	}
+	m, err := fs.decodeMsg(f)
+	if err == nil {
+		err = fs.skipBody()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
-	return fs.msgProtocol.PaserMsg(f), nil
+// ReadPooledMsg reads the next msg like ReadMsg, the frame data is taken from a buffer pool
+// to save the allocation. Call f.Release once m and its data are no longer used.
+func (fs *FrameStream) ReadPooledMsg() (m MsgI, f *Frame, err error) {
+	err = fs.skipBody()
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err = fs.readPooledFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.flags&FrameFlagError != 0 {
+		err = &RemoteError{Msg: string(f.data)}
+		f.Release()
+		return nil, nil, err
+	}
+	if f.flags&FrameFlagChunk != 0 {
+		fs.body = &chunkReader{fs: fs, eof: f.flags&FrameFlagFinal != 0}
+	}
+	m, err = fs.decodeMsg(f)
+	if err == nil {
+		err = fs.skipBody()
+	}
+	if err != nil {
+		f.Release()
+		return nil, nil, err
+	}
+	return m, f, nil
 }
 
 func (fs *FrameStream) WriteMsg(m MsgI) error {
-	f := NewFrame(m.Encode())
-	fs.writeFrame(f)
-	return nil
+	data, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	return fs.writeFrame(NewFrame(data))
+}
+
+// WriteMsgCtx writes m like WriteMsg, the SpanContext of ctx is injected into the frame metadata.
+func (fs *FrameStream) WriteMsgCtx(ctx context.Context, m MsgI) error {
+	data, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	f := NewFrame(data)
+	f.setTrace(SpanContextFromContext(ctx))
+	return fs.writeFrame(f)
 }
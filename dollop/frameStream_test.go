@@ -0,0 +1,105 @@
+package dollop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// legacyEncode is the former BuildMsg and Frame.Encode of a BaseMsg, the frame has no flags.
+func legacyEncode(data []byte) []byte {
+	msgBuf := bytes.NewBuffer([]byte{})
+	binary.Write(msgBuf, binary.BigEndian, BaseMsgTag)
+	binary.Write(msgBuf, binary.BigEndian, data)
+	msg := msgBuf.Bytes()
+
+	frameBuf := bytes.NewBuffer([]byte{})
+	binary.Write(frameBuf, binary.BigEndian, uint32(len(msg)))
+	binary.Write(frameBuf, binary.BigEndian, msg)
+	return frameBuf.Bytes()
+}
+
+// legacyRead is the former ReadMsg of a legacyEncode frame: readFrame allocates the len
+// and the frame buffers, then BaseMsgProtocol.PaserMsg wraps the data.
+func legacyRead(stream io.Reader) (MsgI, error) {
+	lenBuf := make([]byte, FrameLen)
+	_, err := stream.Read(lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	frameBuf := make([]byte, binary.BigEndian.Uint32(lenBuf))
+	_, err = stream.Read(frameBuf)
+	if err != nil {
+		return nil, err
+	}
+	f := NewFrame(frameBuf)
+	switch f.data[0] {
+	case byte(BaseMsgTag):
+		return NewBaseMsg(f.data[BaseMsgTypeLen:]), nil
+	}
+	return nil, nil
+}
+
+var benchSizes = []int{64, 1024, 16 * 1024}
+
+var sinkMsg MsgI // 避免读到的msg被优化掉
+
+func newBenchFrameStream(data []byte) *FrameStream {
+	fs := NewFrameStream(newRepeatStream(NewFrame(NewBaseMsg(data).Encode()).Encode()))
+	fs.BindMsgProtocol(NewBaseMsgProtocol("bench", "v1"))
+	return fs
+}
+
+func BenchmarkFrameWrite(b *testing.B) {
+	for _, size := range benchSizes {
+		data := bytes.Repeat([]byte{'x'}, size)
+		b.Run(fmt.Sprintf("legacy/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			s := newRepeatStream(legacyEncode(data))
+			for i := 0; i < b.N; i++ {
+				s.Write(legacyEncode(data))
+			}
+		})
+		b.Run(fmt.Sprintf("WriteMsg/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			fs := newBenchFrameStream(data)
+			m := NewBaseMsg(data)
+			for i := 0; i < b.N; i++ {
+				fs.WriteMsg(m)
+			}
+		})
+	}
+}
+
+func BenchmarkFrameRead(b *testing.B) {
+	for _, size := range benchSizes {
+		data := bytes.Repeat([]byte{'x'}, size)
+		b.Run(fmt.Sprintf("legacy/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			s := newRepeatStream(legacyEncode(data))
+			for i := 0; i < b.N; i++ {
+				sinkMsg, _ = legacyRead(s)
+			}
+		})
+		b.Run(fmt.Sprintf("ReadMsg/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			fs := newBenchFrameStream(data)
+			for i := 0; i < b.N; i++ {
+				sinkMsg, _ = fs.ReadMsg()
+			}
+		})
+		b.Run(fmt.Sprintf("ReadPooledMsg/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			fs := newBenchFrameStream(data)
+			for i := 0; i < b.N; i++ {
+				m, f, err := fs.ReadPooledMsg()
+				sinkMsg = m
+				if err == nil {
+					f.Release()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package dollop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newPipeFrameStream() *FrameStream {
+	fs := NewFrameStream(&memStream{})
+	fs.BindMsgProtocol(NewBaseMsgProtocol("t", "v1"))
+	return fs
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	trace := SpanContext{TraceID: TraceID{1, 2, 3}, SpanID: SpanID{4, 5}, TraceFlags: 1}
+	traced := NewFrame([]byte("traced"))
+	traced.setTrace(trace)
+	tracedCall := newRPCFrame(FrameFlagCall, 7, []byte("call"))
+	tracedCall.setTrace(trace)
+	frames := []*Frame{
+		NewFrame([]byte("plain")),
+		NewFrame([]byte{}),
+		newRPCFrame(FrameFlagCall, 1, []byte("call")),
+		newRPCFrame(FrameFlagReply|FrameFlagError, 0xffffffff, []byte("boom")),
+		traced,
+		tracedCall,
+		{len: 5, flags: FrameFlagChunk | FrameFlagFinal, data: []byte("chunk")},
+	}
+	for _, pooled := range []bool{false, true} {
+		for _, want := range frames {
+			data := want.Encode()
+			if n := binary.BigEndian.Uint32(data); int(n) != want.bodyLen() || len(data) != FrameLen+want.bodyLen() {
+				t.Errorf("frame %q: len header %d, encoded %d bytes, bodyLen %d", want.data, n, len(data), want.bodyLen())
+			}
+			var lenBuf [FrameLen]byte
+			got, err := readFrame(bytes.NewReader(data), lenBuf[:], len(data), pooled)
+			if err != nil {
+				t.Fatalf("frame %q: %v", want.data, err)
+			}
+			gotTrace, gotTraced := got.SpanContext()
+			wantTrace, wantTraced := want.SpanContext()
+			wantTrace.Remote = wantTraced
+			if got.flags != want.flags || got.callID != want.callID || !bytes.Equal(got.data, want.data) ||
+				gotTraced != wantTraced || gotTrace != wantTrace {
+				t.Errorf("round trip of %+v = %+v", want, got)
+			}
+			if (got.buf != nil) != pooled {
+				t.Errorf("frame %q: pooled = %v, buf = %v", want.data, pooled, got.buf != nil)
+			}
+			got.Release()
+		}
+	}
+}
+
+func TestReadFrameShort(t *testing.T) {
+	header := func(n uint32, rest ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, n), rest...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty stream", nil, io.EOF},
+		{"short len", []byte{0, 0}, ErrShortFrame},
+		{"short body", header(10, 0, 'a'), ErrShortFrame},
+		{"no flags", header(0), ErrShortFrame},
+		{"call without id", header(3, byte(FrameFlagCall), 0, 0), ErrShortFrame},
+		{"trace without meta", header(5, byte(FrameFlagTrace), 1, 2, 3, 4), ErrShortFrame},
+	}
+	for _, tt := range tests {
+		var lenBuf [FrameLen]byte
+		for _, pooled := range []bool{false, true} {
+			_, err := readFrame(bytes.NewReader(tt.data), lenBuf[:], 0, pooled)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s (pooled %v): err = %v, want %v", tt.name, pooled, err, tt.err)
+			}
+		}
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	// 帧头声明的长度超过上限时不读取其数据
+	data := binary.BigEndian.AppendUint32(nil, 1<<30)
+	var lenBuf [FrameLen]byte
+	if _, err := readFrame(bytes.NewReader(data), lenBuf[:], 1024, false); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("read of an oversize frame err = %v", err)
+	}
+
+	fs := newPipeFrameStream()
+	fs.SetMaxFrameSize(64)
+	if err := fs.WriteMsg(NewBaseMsg(make([]byte, 64))); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("write of an oversize frame err = %v", err)
+	}
+	if err := fs.WriteMsg(NewBaseMsg(make([]byte, 64-FrameFlagsLen-BaseMsgTypeLen))); err != nil {
+		t.Errorf("write of a frame of the max size: %v", err)
+	}
+	if _, err := fs.ReadMsg(); err != nil {
+		t.Errorf("read of a frame of the max size: %v", err)
+	}
+}
+
+func TestFrameStreamMsgs(t *testing.T) {
+	fs := newPipeFrameStream()
+	fs.SetMaxFrameSize(1024)
+	body := bytes.Repeat([]byte("0123456789"), 500)
+
+	fs.WriteMsg(NewBaseMsg([]byte("first")))
+	if err := fs.WriteMsgFrom(NewBaseMsg([]byte("head")), bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	fs.WriteMsgFrom(NewBaseMsg([]byte("skipped")), bytes.NewReader(body))
+	fs.WriteMsg(NewBaseMsg([]byte("last")))
+
+	m, err := fs.ReadMsg()
+	if err != nil || string(m.GetData()) != "first" {
+		t.Fatalf("ReadMsg = %v, %v", m, err)
+	}
+	m, r, err := fs.ReadMsgBody()
+	if err != nil || string(m.GetData()) != "head" || r == nil {
+		t.Fatalf("ReadMsgBody = %v, %v, %v", m, r, err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("chunked body = %d bytes, %v, want %d bytes", len(got), err, len(body))
+	}
+	if m, err = fs.ReadMsg(); err != nil || string(m.GetData()) != "skipped" {
+		t.Fatalf("ReadMsg of a chunked msg = %v, %v", m, err)
+	}
+	m, f, err := fs.ReadPooledMsg()
+	if err != nil || string(m.GetData()) != "last" {
+		t.Fatalf("ReadMsg after a skipped body = %v, %v", m, err)
+	}
+	f.Release()
+	if _, err := fs.ReadMsg(); err != io.EOF {
+		t.Errorf("ReadMsg at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestWriteMsgFromTinyMaxFrameSize(t *testing.T) {
+	for _, size := range []int{-1, 0, 1, FrameFlagsLen, FrameFlagsLen + 1} {
+		fs := newPipeFrameStream()
+		fs.SetMaxFrameSize(size)
+		if n := fs.chunkSize(); n < 1 {
+			t.Fatalf("max frame size %d: chunkSize = %d, want at least 1", size, n)
+		}
+		// 以前chunkSize<=0时WriteMsgFrom会死循环
+		done := make(chan error, 1)
+		go func() { done <- fs.WriteMsgFrom(NewBaseMsg([]byte("head")), bytes.NewReader([]byte("body"))) }()
+		recvOrFail(t, done)
+	}
+}
+
+func TestCompressedFrameStream(t *testing.T) {
+	for _, c := range DefaultCompressors() {
+		ps := &memStream{}
+		w, r := NewFrameStream(ps), NewFrameStream(ps)
+		w.setCompression(c, 16)
+		r.setCompression(c, 16)
+		r.BindMsgProtocol(NewBaseMsgProtocol("t", "v1"))
+
+		large := bytes.Repeat([]byte("compress me "), 100)
+		for _, data := range [][]byte{[]byte("tiny"), large} {
+			w.WriteMsg(NewBaseMsg(data))
+			compressed := FrameFlag(ps.buf.Bytes()[FrameLen])&FrameFlagCompressed != 0
+			if compressed != (len(data) > 16) {
+				t.Errorf("%s: frame of %d bytes compressed = %v, min size 16", c.Name(), len(data), compressed)
+			}
+			m, err := r.ReadMsg()
+			if err != nil || !bytes.Equal(m.GetData(), data) {
+				t.Errorf("%s: read %d bytes, %v, want %d bytes", c.Name(), len(m.GetData()), err, len(data))
+			}
+		}
+
+		// 解压后超过上限的帧被拒绝
+		r.SetMaxFrameSize(len(large) / 2)
+		w.WriteMsg(NewBaseMsg(large))
+		if _, err := r.ReadMsg(); !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("%s: read of a frame decompressed over the max size err = %v", c.Name(), err)
+		}
+
+		plain := NewFrameStream(&memStream{})
+		plain.BindMsgProtocol(NewBaseMsgProtocol("t", "v1"))
+		w.rebind(plain.getStream())
+		w.WriteMsg(NewBaseMsg(large))
+		if _, err := plain.ReadMsg(); !errors.Is(err, ErrBadCompressedFrame) {
+			t.Errorf("%s: compressed frame on an uncompressed stream err = %v", c.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package dollop
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// HandlerFunc handles the decoded value of a msg and returns the value replied on the same stream,
+// nil for no reply. Its error goes to the ErrorHandler of the server, a call gets it as a *RemoteError.
+type HandlerFunc[Req, Resp any] func(ctx context.Context, req *Req) (*Resp, error)
+
+// Handle registers Req at tag of cp, unless it is registered there already, and routes its msgs to fn.
+// Resp must be registered to a tag of cp to be replied.
+func Handle[Req, Resp any](cp *CodecProtocol, tag MsgType, fn HandlerFunc[Req, Resp]) error {
+	respType := reflect.TypeOf((*Resp)(nil)).Elem()
+	if _, ok := cp.tagOf(respType); !ok {
+		return fmt.Errorf("%w: reply type %s", ErrTypeNotRegistered, respType)
+	}
+	tag, err := cp.tag(tag)
+	if err != nil {
+		return err
+	}
+	reqType := reflect.TypeOf((*Req)(nil)).Elem()
+	if cp.typeOf(tag) != reqType {
+		err = RegisterType[Req](cp, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return cp.AddM2R(tag, handleRouter[Req, Resp]{cp: cp, fn: fn})
+}
+
+// handleRouter decodes the msg into *Req for fn and replies its *Resp.
+type handleRouter[Req, Resp any] struct {
+	BaseFrameRouter
+	cp *CodecProtocol
+	fn HandlerFunc[Req, Resp]
+}
+
+func (hr handleRouter[Req, Resp]) Handler(req FrameRequestI) error {
+	m, err := req.GetMsg()
+	if err != nil {
+		return err
+	}
+	v, err := MsgValue[Req](m)
+	if err != nil {
+		return err
+	}
+	resp, err := hr.fn(req.Context(), v)
+	if err != nil || resp == nil {
+		return err
+	}
+	out, err := hr.cp.NewMsg(resp)
+	if err != nil {
+		return err
+	}
+	return req.Reply(out)
+}
@@ -0,0 +1,83 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type handlePing struct {
+	N int
+}
+
+type handlePong struct {
+	N    int
+	Echo string
+}
+
+func TestHandleTyped(t *testing.T) {
+	cp := NewCodecProtocol("ping", "v1", JSONCodec{})
+	if err := RegisterType[handlePong](cp, 2); err != nil {
+		t.Fatal(err)
+	}
+	err := Handle(cp, 1, func(ctx context.Context, req *handlePing) (*handlePong, error) {
+		if req.N < 0 {
+			return nil, errors.New("negative")
+		}
+		return &handlePong{N: req.N + 1, Echo: "pong"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Handle 注册了Req的tag
+	if _, err := cp.NewMsg(&handlePing{}); err != nil {
+		t.Fatalf("Req is not registered by Handle: %v", err)
+	}
+
+	_, addr := startTestServer(t, WithMsgProtocol(cp))
+	c := dialTestClient(t, addr, nil)
+	rs, _, err := c.NewRPCStream(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	m, err := cp.NewMsg(&handlePing{N: 41})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := rs.Call(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type() != BaseMsgType(2) {
+		t.Fatalf("reply tag = %v, want the tag of handlePong", reply.Type())
+	}
+	if pong, err := MsgValue[handlePong](reply); err != nil || pong.N != 42 || pong.Echo != "pong" {
+		t.Fatalf("reply = %+v, %v, want {42 pong}", pong, err)
+	}
+
+	m, _ = cp.NewMsg(&handlePing{N: -1})
+	var re *RemoteError
+	if _, err := rs.Call(ctx, m); !errors.As(err, &re) || re.Msg != "negative" {
+		t.Fatalf("Call of a failed handler = %v, want the RemoteError negative", err)
+	}
+}
+
+func TestHandleUnregisteredResp(t *testing.T) {
+	cp := NewCodecProtocol("ping", "v1", JSONCodec{})
+	err := Handle(cp, 1, func(ctx context.Context, req *handlePing) (*handlePong, error) {
+		return &handlePong{}, nil
+	})
+	if !errors.Is(err, ErrTypeNotRegistered) {
+		t.Fatalf("Handle with an unregistered Resp = %v, want ErrTypeNotRegistered", err)
+	}
+	if _, err := cp.GetRouter(BaseMsgType(1)); err == nil {
+		t.Fatal("Handle routed the tag although it failed")
+	}
+	if _, err := cp.NewMsg(&handlePing{}); !errors.Is(err, ErrTypeNotRegistered) {
+		t.Fatalf("Handle registered Req although it failed: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package dollop
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+var (
+	testTLSOnce   sync.Once
+	testServerTLS *tls.Config
+	testClientTLS *tls.Config
+)
+
+// testTLS returns the tls configs of a loopback server and its client, with a self-signed certificate.
+func testTLS(t testing.TB) (server, client *tls.Config) {
+	testTLSOnce.Do(func() {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"localhost"}}
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+		testServerTLS = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"dollop"}}
+		testClientTLS = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"dollop"}}
+	})
+	return testServerTLS, testClientTLS
+}
+
+// memStream is a quic.Stream in memory, its reads return what was written to it.
+// A stream of newRepeatStream reads one encoded frame again and again and discards its writes instead.
+// CancelRead and CancelWrite record their code in reset.
+type memStream struct {
+	quic.Stream // 其余方法不会被调用
+	buf         bytes.Buffer
+	repeat      []byte
+	off         int
+	reset       quic.StreamErrorCode
+}
+
+func newRepeatStream(frame []byte) *memStream {
+	return &memStream{repeat: frame}
+}
+
+func (s *memStream) Read(p []byte) (int, error) {
+	if s.repeat == nil {
+		return s.buf.Read(p)
+	}
+	if s.off == len(s.repeat) {
+		s.off = 0
+	}
+	n := copy(p, s.repeat[s.off:])
+	s.off += n
+	return n, nil
+}
+
+func (s *memStream) Write(p []byte) (int, error) {
+	if s.repeat != nil {
+		return len(p), nil
+	}
+	return s.buf.Write(p)
+}
+
+func (s *memStream) StreamID() quic.StreamID               { return 0 }
+func (s *memStream) CancelRead(code quic.StreamErrorCode)  { s.reset = code }
+func (s *memStream) CancelWrite(code quic.StreamErrorCode) { s.reset = code }
+
+// startTestServer serves a server of opts on a loopback port, it is stopped when the test ends.
+func startTestServer(t testing.TB, opts ...WithConfig) (*Server, string) {
+	st, _ := testTLS(t)
+	s, err := NewServer("test", append(opts, WithTlsConfig(st))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background(), "127.0.0.1:0")
+	t.Cleanup(func() { s.Stop() })
+	for i := 0; i < 200; i++ {
+		s.mutex.Lock()
+		l := s.Listener
+		s.mutex.Unlock()
+		if l != nil {
+			return s, l.Addr().String()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("server did not listen")
+	return nil, ""
+}
+
+// dialTestClient connects a client to addr, setup is called before Connect if not nil.
+func dialTestClient(t testing.TB, addr string, setup func(c *Client)) *Client {
+	_, ct := testTLS(t)
+	c := NewClient("test", ct, DefalutQuicConfig)
+	if setup != nil {
+		setup(c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// recvOrFail receives from ch within a second.
+func recvOrFail[T any](t testing.TB, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	var zero T
+	return zero
+}
+
+// echoRouter replies the data of the msg, with the compressor name of the stream if reportCompressor.
+type echoRouter struct {
+	BaseFrameRouter
+	reportCompressor bool
+}
+
+func (er echoRouter) Handler(req FrameRequestI) error {
+	m, err := req.GetMsg()
+	if err != nil {
+		return err
+	}
+	data := m.GetData()
+	if er.reportCompressor {
+		stream, _ := req.GetStream()
+		name := "none"
+		if c := stream.Compressor(); c != nil {
+			name = c.Name()
+		}
+		data = append([]byte(name+":"), data...)
+	}
+	return req.Reply(NewBaseMsg(data))
+}
+
+// newEchoProtocol returns a protocol whose BaseMsgs are echoed by r.
+func newEchoProtocol(r FrameRouterI) *BaseMsgProtocol {
+	mp := NewBaseMsgProtocol("echo", "v1")
+	mp.AddRouter(BaseMsgTag, r)
+	return mp
+}
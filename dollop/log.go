@@ -0,0 +1,33 @@
+package dollop
+
+import (
+	"context"
+
+	"golang.org/x/exp/slog"
+)
+
+// 日志属性的键
+const (
+	LogKeyConnID     = "conn_id"
+	LogKeyStreamID   = "stream_id"
+	LogKeyRemoteAddr = "remote_addr"
+	LogKeyMsgType    = "msg_type"
+)
+
+// discardHandler drops every record, the framework is silent until a logger is set.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+func streamAttr(id StreamID) slog.Attr {
+	return slog.Int64(LogKeyStreamID, int64(id))
+}
+
+func msgTypeAttr(m MsgI) slog.Attr {
+	return slog.Any(LogKeyMsgType, m.Type())
+}
@@ -0,0 +1,271 @@
+package dollop
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets in seconds, same as the prometheus client.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Metrics is a registry of counters, gauges and histograms.
+// It implements http.Handler and writes all metrics in the prometheus text format.
+type Metrics struct {
+	collectors []collector
+	names      map[string]collector
+	mu         sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{names: make(map[string]collector)}
+}
+
+// register adds c as name, the collector registered as name before is returned instead if any.
+func (m *Metrics) register(name string, c collector) collector {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.names[name]; ok {
+		return old
+	}
+	m.names[name] = c
+	m.collectors = append(m.collectors, c)
+	return c
+}
+
+func registerMismatch(name string) string {
+	return fmt.Sprintf("metric %s is registered as another type", name)
+}
+
+// NewCounter registers a counter as name, or returns the counter registered as name before,
+// so one Metrics can be shared, e.g. by several servers. It panics if name is another type of metric.
+func (m *Metrics) NewCounter(name, help string) *Counter {
+	c, ok := m.register(name, &Counter{name: name, help: help}).(*Counter)
+	if !ok {
+		panic(registerMismatch(name))
+	}
+	return c
+}
+
+// NewGauge registers a gauge as name like NewCounter.
+func (m *Metrics) NewGauge(name, help string) *Gauge {
+	g, ok := m.register(name, &Gauge{name: name, help: help}).(*Gauge)
+	if !ok {
+		panic(registerMismatch(name))
+	}
+	return g
+}
+
+// NewHistogram registers a histogram as name like NewCounter, with the given upper bounds,
+// DefaultBuckets if buckets is nil. The histogram registered before keeps its own buckets.
+func (m *Metrics) NewHistogram(name, help string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	bs := append([]float64{}, buckets...)
+	sort.Float64s(bs)
+	h, ok := m.register(name, &Histogram{name: name, help: help, buckets: bs, counts: make([]uint64, len(bs))}).(*Histogram)
+	if !ok {
+		panic(registerMismatch(name))
+	}
+	return h
+}
+
+// WriteText writes all metrics in the prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mu.Lock()
+	collectors := append([]collector{}, m.collectors...)
+	m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter only goes up. All metric types are safe to use as nil, which records nothing.
+type Counter struct {
+	name, help string
+	v          uint64
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// countingReader adds the bytes read from r to counter.
+type countingReader struct {
+	r       io.Reader
+	counter *Counter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.counter.Add(uint64(n))
+	return n, err
+}
+
+// Gauge goes up and down, e.g. live connections.
+type Gauge struct {
+	name, help string
+	v          int64
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) Add(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.AddInt64(&g.v, n)
+}
+
+func (g *Gauge) Set(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *Gauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+// Histogram counts observations into buckets, e.g. handler durations in seconds.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+	counts     []uint64 // 每个桶自身的计数, 输出时累加
+	sum        float64
+	count      uint64
+	mu         sync.Mutex
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64{}, h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+// serverMetrics are the metrics recorded by the server and its conns,
+// all fields are nil and record nothing if the server has no Metrics.
+type serverMetrics struct {
+	connsAccepted        *Counter
+	connsActive          *Gauge
+	handshakeFailures    *Counter
+	handshakeDuration    *Histogram
+	rawStreams           *Counter
+	rawStreamsActive     *Gauge
+	rawBytesReceived     *Counter
+	frameStreams         *Counter
+	frameStreamsActive   *Gauge
+	framesReceived       *Counter
+	msgsDropped          *Counter
+	frameHandlerDuration *Histogram
+	rawHandlerDuration   *Histogram
+}
+
+func newServerMetrics(m *Metrics) *serverMetrics {
+	if m == nil {
+		return &serverMetrics{}
+	}
+	return &serverMetrics{
+		connsAccepted:        m.NewCounter("dollop_connections_accepted_total", "Connections accepted by the server."),
+		connsActive:          m.NewGauge("dollop_connections_active", "Live server connections."),
+		handshakeFailures:    m.NewCounter("dollop_handshake_failures_total", "Control stream handshakes that failed."),
+		handshakeDuration:    m.NewHistogram("dollop_handshake_duration_seconds", "Time to accept the control stream and exchange Hello.", nil),
+		rawStreams:           m.NewCounter("dollop_raw_streams_total", "Raw streams processed by the server."),
+		rawStreamsActive:     m.NewGauge("dollop_raw_streams_active", "Live raw streams."),
+		rawBytesReceived:     m.NewCounter("dollop_raw_bytes_received_total", "Bytes read from raw streams."),
+		frameStreams:         m.NewCounter("dollop_frame_streams_total", "Frame streams processed by the server."),
+		frameStreamsActive:   m.NewGauge("dollop_frame_streams_active", "Live frame streams."),
+		framesReceived:       m.NewCounter("dollop_frames_received_total", "Frames read from frame streams."),
+		msgsDropped:          m.NewCounter("dollop_msgs_dropped_total", "Msgs dropped because they could not be parsed or had no router."),
+		frameHandlerDuration: m.NewHistogram("dollop_frame_handler_duration_seconds", "Duration of frame router PreHandler, Handler and AfterHandler.", nil),
+		rawHandlerDuration:   m.NewHistogram("dollop_raw_handler_duration_seconds", "Duration of the raw routers on one read.", nil),
+	}
+}
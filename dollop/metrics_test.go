@@ -0,0 +1,32 @@
+package dollop
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsSharedByServers(t *testing.T) {
+	m := NewMetrics()
+	st, _ := testTLS(t)
+	for i := 0; i < 2; i++ {
+		if _, err := NewServer("test", WithTlsConfig(st), WithMetrics(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	if n := strings.Count(buf.String(), "# TYPE dollop_connections_accepted_total "); n != 1 {
+		t.Errorf("dollop_connections_accepted_total written %d times", n)
+	}
+
+	if m.NewCounter("c", "") != m.NewCounter("c", "") {
+		t.Error("NewCounter of a registered name returned another counter")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a counter name as a gauge did not panic")
+		}
+	}()
+	m.NewGauge("c", "")
+}
@@ -0,0 +1,146 @@
+package dollop
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// FrameHandlerFunc handles one frame request, a router is adapted into it by FrameRouterHandler.
+type FrameHandlerFunc func(req FrameRequestI) error
+
+// FrameMiddleware wraps the next handler, it may run code around next, observe its error,
+// or short-circuit by not calling next at all, e.g. auth, logging, rate limiting, metrics.
+type FrameMiddleware func(next FrameHandlerFunc) FrameHandlerFunc
+
+type RawHandlerFunc func(req RawRequestI) error
+
+type RawMiddleware func(next RawHandlerFunc) RawHandlerFunc
+
+// FrameRouterHandler adapts the PreHandler/Handler/AfterHandler triple of r into a FrameHandlerFunc.
+// An error of PreHandler skips Handler and AfterHandler, AfterHandler runs even if Handler failed.
+func FrameRouterHandler(r FrameRouterI) FrameHandlerFunc {
+	return func(req FrameRequestI) error {
+		err := r.PreHandler(req)
+		if err != nil {
+			return err
+		}
+		err = r.Handler(req)
+		afterErr := r.AfterHandler(req)
+		if err != nil {
+			return err
+		}
+		return afterErr
+	}
+}
+
+// RawRoutersHandler adapts raw routers into a RawHandlerFunc, the routers run in order
+// and the first error stops the rest.
+func RawRoutersHandler(rs []RawRouterI) RawHandlerFunc {
+	return func(req RawRequestI) error {
+		for _, r := range rs {
+			err := r.PreHandler(req)
+			if err != nil {
+				return err
+			}
+			err = r.Handler(req)
+			afterErr := r.AfterHandler(req)
+			if err != nil {
+				return err
+			}
+			if afterErr != nil {
+				return afterErr
+			}
+		}
+		return nil
+	}
+}
+
+// ChainFrame wraps h with mws, mws[0] is the outermost.
+func ChainFrame(h FrameHandlerFunc, mws ...FrameMiddleware) FrameHandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// ChainRaw wraps h with mws, mws[0] is the outermost.
+func ChainRaw(h RawHandlerFunc, mws ...RawMiddleware) RawHandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// FrameMiddlewaresI is optionally implemented by a MsgProtocolI to wrap the routers of its msgs,
+// embed MiddlewareSet to implement it.
+type FrameMiddlewaresI interface {
+	FrameMiddlewares(tag MsgType) []FrameMiddleware
+}
+
+// MiddlewareSet holds the middlewares of a msg protocol, for all its msgs or per msg tag.
+// Register them before the protocol is bound to a stream.
+type MiddlewareSet struct {
+	all   []FrameMiddleware
+	byTag map[MsgType][]FrameMiddleware
+}
+
+// Use adds mws for all msgs of the protocol.
+func (ms *MiddlewareSet) Use(mws ...FrameMiddleware) {
+	ms.all = append(ms.all, mws...)
+}
+
+// UseFor adds mws for the msgs of tag only, they run inside the middlewares added by Use.
+func (ms *MiddlewareSet) UseFor(tag MsgType, mws ...FrameMiddleware) {
+	if ms.byTag == nil {
+		ms.byTag = make(map[MsgType][]FrameMiddleware)
+	}
+	ms.byTag[tag] = append(ms.byTag[tag], mws...)
+}
+
+func (ms MiddlewareSet) FrameMiddlewares(tag MsgType) []FrameMiddleware {
+	tagMws := ms.byTag[tag]
+	if len(tagMws) == 0 {
+		return ms.all
+	}
+	mws := make([]FrameMiddleware, 0, len(ms.all)+len(tagMws))
+	mws = append(mws, ms.all...)
+	return append(mws, tagMws...)
+}
+
+// PanicError is the error of a handler that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// safeCall calls f and turns its panic into a *PanicError.
+func safeCall(f func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return f()
+}
+
+// RecoverFrame turns a panic of the next handlers into a *PanicError.
+func RecoverFrame() FrameMiddleware {
+	return func(next FrameHandlerFunc) FrameHandlerFunc {
+		return func(req FrameRequestI) error {
+			return safeCall(func() error { return next(req) })
+		}
+	}
+}
+
+// RecoverRaw turns a panic of the next handlers into a *PanicError.
+func RecoverRaw() RawMiddleware {
+	return func(next RawHandlerFunc) RawHandlerFunc {
+		return func(req RawRequestI) error {
+			return safeCall(func() error { return next(req) })
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mwProtocol is a BaseMsgProtocol with its own middlewares.
+type mwProtocol struct {
+	*BaseMsgProtocol
+	MiddlewareSet
+}
+
+// callRecorder returns a middleware which records name before calling next.
+func callRecorder(mu *sync.Mutex, calls *[]string, name string) FrameMiddleware {
+	return func(next FrameHandlerFunc) FrameHandlerFunc {
+		return func(req FrameRequestI) error {
+			mu.Lock()
+			*calls = append(*calls, name)
+			mu.Unlock()
+			return next(req)
+		}
+	}
+}
+
+// denyMiddleware short-circuits the msg "deny" with an error.
+func denyMiddleware(next FrameHandlerFunc) FrameHandlerFunc {
+	return func(req FrameRequestI) error {
+		m, err := req.GetMsg()
+		if err == nil && string(m.GetData()) == "deny" {
+			return errors.New("denied")
+		}
+		return next(req)
+	}
+}
+
+func TestFrameMiddlewareChain(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	mp := &mwProtocol{BaseMsgProtocol: newEchoProtocol(echoRouter{})}
+	mp.Use(callRecorder(&mu, &calls, "protocol"), denyMiddleware)
+	mp.UseFor(BaseMsgTag, callRecorder(&mu, &calls, "tag"))
+	mp.UseFor(BaseMsgType(2), callRecorder(&mu, &calls, "other tag"))
+	_, addr := startTestServer(t, WithMsgProtocol(mp),
+		WithFrameMiddleware(callRecorder(&mu, &calls, "global 1"), callRecorder(&mu, &calls, "global 2")))
+	c := dialTestClient(t, addr, nil)
+	rs, _, err := c.NewRPCStream(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if m, err := rs.Call(ctx, NewBaseMsg([]byte("hi"))); err != nil || string(m.GetData()) != "hi" {
+		t.Fatalf("Call = %v, %v", m, err)
+	}
+	mu.Lock()
+	got := strings.Join(calls, ",")
+	calls = nil
+	mu.Unlock()
+	if want := "global 1,global 2,protocol,tag"; got != want {
+		t.Fatalf("middlewares ran %q, want %q", got, want)
+	}
+
+	// denyMiddleware不调用next, tag中间件和handler都不会执行
+	_, err = rs.Call(ctx, NewBaseMsg([]byte("deny")))
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Msg != "denied" {
+		t.Fatalf("Call of a denied msg = %v, want the RemoteError denied", err)
+	}
+	mu.Lock()
+	got = strings.Join(calls, ",")
+	mu.Unlock()
+	if want := "global 1,global 2,protocol"; got != want {
+		t.Fatalf("middlewares ran %q for a short-circuited msg, want %q", got, want)
+	}
+}
+
+func TestRecoverFrame(t *testing.T) {
+	var observed error
+	observe := func(next FrameHandlerFunc) FrameHandlerFunc {
+		return func(req FrameRequestI) error {
+			observed = next(req)
+			return observed
+		}
+	}
+	h := ChainFrame(func(req FrameRequestI) error { panic("boom") }, observe, RecoverFrame())
+
+	err := h(nil)
+	var pe *PanicError
+	if !errors.As(err, &pe) || pe.Value != "boom" || len(pe.Stack) == 0 {
+		t.Fatalf("handler = %v, want a *PanicError of boom with its stack", err)
+	}
+	if observed != err {
+		t.Fatalf("outer middleware observed %v, want the *PanicError", observed)
+	}
+
+	ok := ChainFrame(func(req FrameRequestI) error { return nil }, RecoverFrame())
+	if err := ok(nil); err != nil {
+		t.Fatalf("handler without panic = %v", err)
+	}
+}
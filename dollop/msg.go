@@ -1,13 +1,20 @@
 package dollop
 
 import (
-	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
-// default uint8,
-// can set any type for this field
+var (
+	// ErrUnknownMsg be returned if the msg protocol can not parse a frame at all.
+	ErrUnknownMsg = errors.New("unknown msg")
+	// ErrRouterNotFound be returned if a msg has no router.
+	ErrRouterNotFound = errors.New("msg has not a valid router")
+	// ErrBadMsgTag be returned if a tag is not of the tag type of the msg protocol.
+	ErrBadMsgTag = errors.New("bad msg tag")
+)
+
+// default uint8, see TagEncoding for the tag types a msg protocol may declare
 type MsgType interface{}
 
 type MsgI interface {
@@ -22,17 +29,88 @@ type MsgI interface {
 type MsgProtocolI interface {
 	Name() string
 	Version() string
-	PaserMsg(f *Frame) MsgI
+	PaserMsg(f *Frame) MsgI // 返回后不能再持有f, ReadMsg会复用它; msg可以持有f.data
 	AddM2R(tag MsgType, router FrameRouterI) error
 	GetRouter(tag MsgType) (FrameRouterI, error)
 }
 
-// common function: build msg
+// FallbackRouterI is optionally implemented by a MsgProtocolI,
+// the fallback router handles the msgs without their own router, including UnknownMsg.
+type FallbackRouterI interface {
+	FallbackRouter() FrameRouterI
+}
+
+// NotFoundReplierI is optionally implemented by a MsgProtocolI, it builds the reply
+// to a msg which has neither its own router nor a fallback router.
+// Without it the peer gets ErrRouterNotFound as a *RemoteError.
+type NotFoundReplierI interface {
+	NotFoundMsg(m MsgI) MsgI
+}
+
+// UnknownMsg is returned by PaserMsg for a tag the protocol does not know, e.g. sent by a newer peer,
+// so it can still reach the fallback router.
+type UnknownMsg struct {
+	tag  MsgType
+	data []byte // 整个msg, 包含tag
+}
+
+func NewUnknownMsg(tag MsgType, data []byte) *UnknownMsg {
+	return &UnknownMsg{tag: tag, data: data}
+}
+
+func (um UnknownMsg) Type() MsgType {
+	return um.tag
+}
+
+func (um UnknownMsg) Encode() []byte {
+	return um.data
+}
+
+func (um UnknownMsg) GetData() []byte {
+	return um.data
+}
+
+// BuildMsg encodes msgTag followed by data, the kind of msgTag selects its TagEncoding, so a named type
+// like `type MyTag uint16` is encoded as its underlying type: the uint8 and uint16 kinds by their width,
+// the other non-negative integers as varint and the strings by TagString.
+// It returns nil if msgTag can not be encoded, which the FrameStream writes return as ErrBadMsgTag;
+// call CheckMsgTag when registering a tag to reject it earlier.
 func BuildMsg(msgTag MsgType, data []byte) []byte {
-	frameBuf := bytes.NewBuffer([]byte{})
-	binary.Write(frameBuf, binary.BigEndian, msgTag)
-	binary.Write(frameBuf, binary.BigEndian, data)
-	return frameBuf.Bytes()
+	// uint8的tag不经过反射
+	switch t := msgTag.(type) {
+	case BaseMsgType:
+		return buildUint8Msg(byte(t), data)
+	case ControlMsgType:
+		return buildUint8Msg(byte(t), data)
+	case uint8:
+		return buildUint8Msg(t, data)
+	}
+	enc, err := tagEncodingOf(msgTag)
+	if err != nil {
+		return nil
+	}
+	tag, err := enc.Tag(msgTag)
+	if err != nil {
+		return nil
+	}
+	msgBuf, _ := enc.AppendTag(make([]byte, 0, tagLen(tag)+len(data)), tag) // tag已转换为enc的类型
+	return append(msgBuf, data...)
+}
+
+// encodeMsg encodes m, ErrBadMsgTag is returned if BuildMsg could not encode its tag.
+func encodeMsg(m MsgI) ([]byte, error) {
+	data := m.Encode()
+	if data == nil {
+		return nil, fmt.Errorf("%w: can not encode %v (%T)", ErrBadMsgTag, m.Type(), m.Type())
+	}
+	return data, nil
+}
+
+func buildUint8Msg(tag byte, data []byte) []byte {
+	msgBuf := make([]byte, 1+len(data))
+	msgBuf[0] = tag
+	copy(msgBuf[1:], data)
+	return msgBuf
 }
 
 // default Base Msg protocol
@@ -42,7 +120,8 @@ type BaseMsgType uint8
 const BaseMsgTypeLen int = 1
 
 const (
-	BaseMsgTag BaseMsgType = 0x01
+	BaseMsgTag     BaseMsgType = 0x01
+	NotFoundMsgTag BaseMsgType = 0xFF // 回复没有router的msg, data为该msg的tag
 )
 
 // base Msg
@@ -66,11 +145,44 @@ func NewBaseMsg(data []byte) *BaseMsg {
 	return &BaseMsg{data: data}
 }
 
+// NotFoundMsg is the reply to a msg without router, its data is the encoded tag of that msg.
+type NotFoundMsg struct {
+	tag  MsgType // 非uint8协议的NotFoundTag, nil为NotFoundMsgTag
+	data []byte
+}
+
+func (nm NotFoundMsg) Type() MsgType {
+	if nm.tag != nil {
+		return nm.tag
+	}
+	return NotFoundMsgTag
+}
+
+func (nm NotFoundMsg) Encode() []byte {
+	return BuildMsg(nm.Type(), nm.data)
+}
+
+func (nm NotFoundMsg) GetData() []byte {
+	return nm.data
+}
+
+func NewNotFoundMsg(data []byte) *NotFoundMsg {
+	return &NotFoundMsg{data: data}
+}
+
 // base Msg protocol
 type BaseMsgProtocol struct {
-	name    string
-	version string
-	M2R     map[BaseMsgType]FrameRouterI
+	MiddlewareSet // 协议级和msg级的中间件
+	name          string
+	version       string
+	M2R           map[BaseMsgType]FrameRouterI
+	fallback      FrameRouterI
+}
+
+// NewBaseMsgProtocol creates a BaseMsgProtocol without routers, name and version identify it
+// when a client asks for it by Client.NewFrameStream.
+func NewBaseMsgProtocol(name, version string) *BaseMsgProtocol {
+	return &BaseMsgProtocol{name: name, version: version, M2R: make(map[BaseMsgType]FrameRouterI)}
 }
 
 func (bmp BaseMsgProtocol) Name() string {
@@ -81,30 +193,75 @@ func (bmp BaseMsgProtocol) Version() string {
 	return bmp.version
 }
 
+func (bmp BaseMsgProtocol) TagEncoding() TagEncoding {
+	return TagUint8
+}
+
 func (bmp BaseMsgProtocol) PaserMsg(f *Frame) MsgI {
+	if len(f.data) < BaseMsgTypeLen {
+		return nil
+	}
 	msgType := f.data[0]
 	dataBuf := f.data[BaseMsgTypeLen:]
 
 	switch msgType {
 	case byte(BaseMsgTag):
 		return NewBaseMsg(dataBuf)
+	case byte(NotFoundMsgTag):
+		return NewNotFoundMsg(dataBuf)
 	}
-	return nil
+	return NewUnknownMsg(BaseMsgType(msgType), f.data)
 }
 
+// AddM2R accepts a tag of any integer type in the uint8 range, e.g. `type MyTag uint8`.
 func (bmp *BaseMsgProtocol) AddM2R(tag MsgType, router FrameRouterI) error {
-	t := tag.(BaseMsgType)
-	bmp.M2R[t] = router
+	t, err := TagUint8.Tag(tag)
+	if err != nil {
+		return err
+	}
+	bmp.AddRouter(t.(BaseMsgType), router)
 	return nil
 }
 
+// AddRouter is AddM2R with the tag type checked at compile time.
+func (bmp *BaseMsgProtocol) AddRouter(tag BaseMsgType, router FrameRouterI) {
+	if bmp.M2R == nil {
+		bmp.M2R = make(map[BaseMsgType]FrameRouterI)
+	}
+	bmp.M2R[tag] = router
+}
+
 func (bmp BaseMsgProtocol) GetRouter(tag MsgType) (FrameRouterI, error) {
-	t := tag.(BaseMsgType)
+	t, ok := tag.(BaseMsgType)
+	if !ok {
+		ct, err := TagUint8.Tag(tag)
+		if err != nil {
+			return nil, ErrRouterNotFound
+		}
+		t = ct.(BaseMsgType)
+	}
 	r := bmp.M2R[t]
 	if r != nil {
 		return bmp.M2R[t], nil
 	}
-	return nil, fmt.Errorf("msg has not a valid router")
+	return nil, ErrRouterNotFound
+}
+
+// SetFallbackRouter sets the router of the msgs without their own router.
+func (bmp *BaseMsgProtocol) SetFallbackRouter(r FrameRouterI) {
+	bmp.fallback = r
+}
+
+func (bmp BaseMsgProtocol) FallbackRouter() FrameRouterI {
+	return bmp.fallback
+}
+
+func (bmp BaseMsgProtocol) NotFoundMsg(m MsgI) MsgI {
+	var tag []byte
+	if t, ok := m.Type().(BaseMsgType); ok {
+		tag = []byte{byte(t)}
+	}
+	return NewNotFoundMsg(tag)
 }
 
 var defaultMsgProtocol = &BaseMsgProtocol{
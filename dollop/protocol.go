@@ -0,0 +1,115 @@
+package dollop
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// BadAckStreamCode resets a requested frame stream whose first msg is neither an Ack nor a Reject.
+const BadAckStreamCode quic.StreamErrorCode = 0x03
+
+var (
+	// ErrProtocolNotFound be returned if the server has no msg protocol of the name and versions asked by the client.
+	ErrProtocolNotFound = errors.New("msg protocol not found")
+	// ErrProtocolExists be returned by registering a msg protocol whose name and version are registered.
+	ErrProtocolExists = errors.New("msg protocol already registered")
+	// ErrBadProtocolName be returned if the name or a version of a msg protocol is empty or longer than 255 bytes.
+	ErrBadProtocolName = errors.New("bad msg protocol name or version")
+	// ErrStreamRejected be returned by opening a stream the server answered with RejectStreamMsg.
+	ErrStreamRejected = errors.New("stream rejected")
+)
+
+// ProtocolRegistry holds the msg protocols a server binds to new frame streams, keyed by Name and Version.
+type ProtocolRegistry struct {
+	mu        sync.RWMutex
+	protocols map[string][]MsgProtocolI // name -> 按注册顺序的各版本
+}
+
+func NewProtocolRegistry() *ProtocolRegistry {
+	return &ProtocolRegistry{protocols: make(map[string][]MsgProtocolI)}
+}
+
+func (pr *ProtocolRegistry) Register(mp MsgProtocolI) error {
+	if !validProtocolString(mp.Name()) || !validProtocolString(mp.Version()) {
+		return fmt.Errorf("%w: %q %q", ErrBadProtocolName, mp.Name(), mp.Version())
+	}
+	if enc := tagEncodingOfProtocol(mp); enc > TagString {
+		return fmt.Errorf("%w: %s %s declares %s", ErrBadMsgTag, mp.Name(), mp.Version(), enc)
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	for _, p := range pr.protocols[mp.Name()] {
+		if p.Version() == mp.Version() {
+			return fmt.Errorf("%w: %s %s", ErrProtocolExists, mp.Name(), mp.Version())
+		}
+	}
+	pr.protocols[mp.Name()] = append(pr.protocols[mp.Name()], mp)
+	return nil
+}
+
+func (pr *ProtocolRegistry) Get(name, version string) (MsgProtocolI, error) {
+	return pr.Negotiate(name, []string{version})
+}
+
+// Negotiate returns the protocol of name in the first of versions which is registered,
+// or the latest registered version if versions is empty.
+func (pr *ProtocolRegistry) Negotiate(name string, versions []string) (MsgProtocolI, error) {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	registered := pr.protocols[name]
+	if len(registered) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrProtocolNotFound, name)
+	}
+	if len(versions) == 0 {
+		return registered[len(registered)-1], nil
+	}
+	for _, v := range versions {
+		for _, p := range registered {
+			if p.Version() == v {
+				return p, nil
+			}
+		}
+	}
+	have := make([]string, 0, len(registered))
+	for _, p := range registered {
+		have = append(have, p.Version())
+	}
+	return nil, fmt.Errorf("%w: %s %v, server has %v", ErrProtocolNotFound, name, versions, have)
+}
+
+func validProtocolString(s string) bool {
+	return len(s) > 0 && len(s) <= 255
+}
+
+// encodeProtocol encodes a protocol name and versions as | len [1] | name | len [1] | version | ... |.
+func encodeProtocol(name string, versions ...string) ([]byte, error) {
+	data := make([]byte, 0, 1+len(name)+8*len(versions))
+	for _, s := range append([]string{name}, versions...) {
+		if !validProtocolString(s) {
+			return nil, fmt.Errorf("%w: %q", ErrBadProtocolName, s)
+		}
+		data = append(data, byte(len(s)))
+		data = append(data, s...)
+	}
+	return data, nil
+}
+
+// decodeProtocol decodes the data of encodeProtocol, name is empty for empty data.
+func decodeProtocol(data []byte) (name string, versions []string, err error) {
+	var strs []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if n == 0 || len(data) < 1+n {
+			return "", nil, fmt.Errorf("%w: malformed", ErrBadProtocolName)
+		}
+		strs = append(strs, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	if len(strs) == 0 {
+		return "", nil, nil
+	}
+	return strs[0], strs[1:], nil
+}
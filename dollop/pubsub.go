@@ -0,0 +1,171 @@
+package dollop
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrSubscribeClosedConn be returned by Broker.Subscribe for a conn which is closed already.
+var ErrSubscribeClosedConn = errors.New("subscribe on a closed conn")
+
+// SlowConsumerPolicy decides what happens when a subscriber's queue is full.
+type SlowConsumerPolicy uint8
+
+const (
+	SlowConsumerDrop       SlowConsumerPolicy = iota // 丢弃该订阅者的这条msg
+	SlowConsumerDisconnect                           // 断开该订阅者的连接
+)
+
+// DefaultTopicQueueSize is the queue size of each subscriber.
+const DefaultTopicQueueSize int = 64
+
+// subscriber delivers the msgs of one topic to one conn over a frame stream.
+type subscriber struct {
+	conn      ConnectionIS
+	stream    FrameStreamI
+	queue     chan MsgI
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (sub *subscriber) writeLoop(onErr func()) {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case m := <-sub.queue:
+			err := sub.stream.WriteMsg(m)
+			if err != nil {
+				onErr()
+				return
+			}
+		}
+	}
+}
+
+func (sub *subscriber) stop() {
+	sub.closeOnce.Do(func() { close(sub.done) })
+}
+
+// Broker fans out published msgs to all conns subscribed to a topic.
+// Every subscriber has a bounded queue, a full queue is handled by the SlowConsumerPolicy.
+type Broker struct {
+	topics    map[string]map[ConnID]*subscriber
+	queueSize int
+	policy    SlowConsumerPolicy
+	mu        sync.RWMutex
+}
+
+func NewBroker(queueSize int, policy SlowConsumerPolicy) *Broker {
+	if queueSize <= 0 {
+		queueSize = DefaultTopicQueueSize
+	}
+	return &Broker{topics: make(map[string]map[ConnID]*subscriber), queueSize: queueSize, policy: policy}
+}
+
+// Subscribe delivers the msgs of topic to stream, a conn subscribes a topic at most once,
+// subscribing again replaces the stream. It returns ErrSubscribeClosedConn if conn is closed.
+func (b *Broker) Subscribe(conn ConnectionIS, topic string, stream FrameStreamI) error {
+	if stream == nil {
+		return fmt.Errorf("subscribe %s with nil stream", topic)
+	}
+	sub := &subscriber{conn: conn, stream: stream, queue: make(chan MsgI, b.queueSize), done: make(chan struct{})}
+
+	b.mu.Lock()
+	// 连接关闭时先标记closed再调用UnsubscribeAll, 在锁内检查可保证订阅不会残留
+	if conn.isClosed() {
+		b.mu.Unlock()
+		return ErrSubscribeClosedConn
+	}
+	subs, ok := b.topics[topic]
+	if !ok {
+		subs = make(map[ConnID]*subscriber)
+		b.topics[topic] = subs
+	}
+	old := subs[conn.ID()]
+	subs[conn.ID()] = sub
+	b.mu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	go sub.writeLoop(func() { b.remove(topic, sub) })
+	return nil
+}
+
+func (b *Broker) Unsubscribe(conn ConnectionIS, topic string) {
+	b.mu.Lock()
+	sub := b.topics[topic][conn.ID()]
+	b.mu.Unlock()
+
+	if sub != nil {
+		b.remove(topic, sub)
+	}
+}
+
+// UnsubscribeAll removes all subscriptions of conn, called when the conn is closed.
+func (b *Broker) UnsubscribeAll(conn ConnectionIS) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for topic, subs := range b.topics {
+		if sub, ok := subs[conn.ID()]; ok {
+			sub.stop()
+			delete(subs, conn.ID())
+		}
+		if len(subs) == 0 {
+			delete(b.topics, topic)
+		}
+	}
+}
+
+// remove removes sub only if it is still the current subscriber of its conn.
+func (b *Broker) remove(topic string, sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub.stop()
+	subs := b.topics[topic]
+	if subs[sub.conn.ID()] == sub {
+		delete(subs, sub.conn.ID())
+	}
+	if len(subs) == 0 {
+		delete(b.topics, topic)
+	}
+}
+
+// Publish queues m to every subscriber of topic, and returns how many subscribers got it.
+func (b *Broker) Publish(topic string, m MsgI) int {
+	b.mu.RLock()
+	subs := make([]*subscriber, 0, len(b.topics[topic]))
+	for _, sub := range b.topics[topic] {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
+
+	delivered := 0
+	for _, sub := range subs {
+		select {
+		case sub.queue <- m:
+			delivered++
+			continue
+		default:
+		}
+
+		// 订阅者队列已满
+		switch b.policy {
+		case SlowConsumerDisconnect:
+			b.remove(topic, sub)
+			sub.conn.closeWithError(SlowConsumerCloseCode, "slow consumer of topic "+topic)
+		default:
+			sub.conn.Logger().Warn("drop msg for slow consumer", "topic", topic)
+		}
+	}
+	return delivered
+}
+
+// SubscriberCount returns how many conns subscribe topic.
+func (b *Broker) SubscriberCount(topic string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.topics[topic])
+}
@@ -0,0 +1,142 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// blockingStream is a subscriber stream whose WriteMsg blocks until release is closed.
+type blockingStream struct {
+	FrameStreamI
+	writes  chan MsgI
+	release chan struct{}
+}
+
+func newBlockingStream() *blockingStream {
+	return &blockingStream{writes: make(chan MsgI, 16), release: make(chan struct{})}
+}
+
+func (bs *blockingStream) WriteMsg(m MsgI) error {
+	bs.writes <- m
+	<-bs.release
+	return nil
+}
+
+// connectedConn dials addr and returns the client and its server side conn, which OnConnect passes to conns.
+func connectedConn(t *testing.T, addr string, conns chan ConnectionIS) (*Client, ConnectionIS) {
+	c := dialTestClient(t, addr, nil)
+	return c, recvOrFail(t, conns)
+}
+
+func TestPublishFanOut(t *testing.T) {
+	s, addr := startTestServer(t)
+	streams := make([]FrameStreamI, 3)
+	for i := range streams {
+		c := dialTestClient(t, addr, nil)
+		fs, _, err := c.NewFrameStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Subscribe("news", fs); err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = fs
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Broker.SubscriberCount("news") < len(streams) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers, want %d", s.Broker.SubscriberCount("news"), len(streams))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if n := s.Publish("news", NewBaseMsg([]byte("hello"))); n != len(streams) {
+		t.Fatalf("Publish delivered to %d, want %d", n, len(streams))
+	}
+	if n := s.Publish("other", NewBaseMsg([]byte("nobody"))); n != 0 {
+		t.Fatalf("Publish of a topic without subscribers delivered to %d", n)
+	}
+	for i, fs := range streams {
+		if m, err := fs.ReadMsg(); err != nil || string(m.GetData()) != "hello" {
+			t.Fatalf("subscriber %d read %v, %v", i, m, err)
+		}
+	}
+}
+
+func TestSlowConsumerDrop(t *testing.T) {
+	conns := make(chan ConnectionIS, 1)
+	s, addr := startTestServer(t, WithTopicQueueSize(1), WithSlowConsumerPolicy(SlowConsumerDrop),
+		WithOnConnect(func(conn ConnectionIS) { conns <- conn }))
+	_, conn := connectedConn(t, addr, conns)
+	bs := newBlockingStream()
+	defer close(bs.release)
+	if err := s.Broker.Subscribe(conn, "news", bs); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Publish("news", NewBaseMsg([]byte("1")))
+	recvOrFail(t, bs.writes) // writeLoop阻塞在第一条msg
+	if n := s.Publish("news", NewBaseMsg([]byte("2"))); n != 1 {
+		t.Fatalf("Publish into the queue delivered to %d, want 1", n)
+	}
+	if n := s.Publish("news", NewBaseMsg([]byte("3"))); n != 0 {
+		t.Fatalf("Publish into a full queue delivered to %d, want 0", n)
+	}
+	if conn.isClosed() || s.Broker.SubscriberCount("news") != 1 {
+		t.Fatal("SlowConsumerDrop removed the subscriber or closed its conn")
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	conns := make(chan ConnectionIS, 1)
+	s, addr := startTestServer(t, WithTopicQueueSize(1), WithSlowConsumerPolicy(SlowConsumerDisconnect),
+		WithOnConnect(func(conn ConnectionIS) { conns <- conn }))
+	c, conn := connectedConn(t, addr, conns)
+	bs := newBlockingStream()
+	defer close(bs.release)
+	if err := s.Broker.Subscribe(conn, "news", bs); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Publish("news", NewBaseMsg([]byte("1")))
+	recvOrFail(t, bs.writes)
+	s.Publish("news", NewBaseMsg([]byte("2")))
+	if n := s.Publish("news", NewBaseMsg([]byte("3"))); n != 0 {
+		t.Fatalf("Publish into a full queue delivered to %d, want 0", n)
+	}
+	if s.Broker.SubscriberCount("news") != 0 {
+		t.Fatal("the slow subscriber was not removed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := c.getConn().qconn.AcceptUniStream(ctx)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != SlowConsumerCloseCode {
+		t.Fatalf("client saw %v, want the close with SlowConsumerCloseCode", err)
+	}
+}
+
+func TestSubscribeClosedConn(t *testing.T) {
+	conns := make(chan ConnectionIS, 1)
+	disconnected := make(chan ConnectionIS, 1)
+	s, addr := startTestServer(t, WithOnConnect(func(conn ConnectionIS) { conns <- conn }),
+		WithOnDisconnect(func(conn ConnectionIS) { disconnected <- conn }))
+	c, conn := connectedConn(t, addr, conns)
+	c.Close()
+	recvOrFail(t, disconnected)
+
+	// UnsubscribeAll已经执行过, 再订阅的subscriber和writeLoop不会再被清理
+	bs := newBlockingStream()
+	defer close(bs.release)
+	if err := s.Broker.Subscribe(conn, "news", bs); !errors.Is(err, ErrSubscribeClosedConn) {
+		t.Fatalf("Subscribe on a closed conn = %v, want ErrSubscribeClosedConn", err)
+	}
+	if n := s.Broker.SubscriberCount("news"); n != 0 {
+		t.Fatalf("%d subscribers after subscribing a closed conn", n)
+	}
+}
@@ -1,21 +1,30 @@
 package dollop
 
 import (
+	"sync"
+
 	"github.com/quic-go/quic-go"
 )
 
 // RawStream is equal to quic.Stream.
 type RawStreamI interface {
 	StreamID() StreamID
-	BindRawRouter(r RawRouterI)
+	// BindSplitter makes the server hand the routers one record of s per RawRequest
+	// instead of the bytes of one read. Bound by a raw router meanwhile, it applies from the next record,
+	// or from the next read if the stream was not split yet.
+	BindSplitter(s SplitterI)
+	Splitter() SplitterI
 	Read(p []byte) (n int, err error)
 	Write(p []byte) (n int, err error)
 	Close() error
+	CloseWithError(code quic.StreamErrorCode) // 以错误码重置流
 }
 
 type RawStream struct {
-	stream  quic.Stream
-	routers []RawRouterI
+	stream   quic.Stream
+	splitter SplitterI
+	smu      sync.RWMutex // 保护stream和splitter, 重连后stream会被替换
+	closed   bool
 }
 
 // NewFrameStream creates a new FrameStream.
@@ -23,22 +32,62 @@ func NewRawStream(s quic.Stream) *RawStream {
 	return &RawStream{stream: s}
 }
 
-func (rs *RawStream) BindRawRouter(r RawRouterI) {
-	rs.routers = append(rs.routers, r)
+func (rs *RawStream) getStream() quic.Stream {
+	rs.smu.RLock()
+	defer rs.smu.RUnlock()
+	return rs.stream
+}
+
+// rebind replaces the underlying stream after the client reconnected,
+// so the RawStream held by the application keeps working.
+func (rs *RawStream) rebind(s quic.Stream) {
+	rs.smu.Lock()
+	defer rs.smu.Unlock()
+	rs.stream = s
+}
+
+func (rs *RawStream) isClosed() bool {
+	rs.smu.RLock()
+	defer rs.smu.RUnlock()
+	return rs.closed
+}
+
+func (rs *RawStream) BindSplitter(s SplitterI) {
+	rs.smu.Lock()
+	defer rs.smu.Unlock()
+	rs.splitter = s
+}
+
+func (rs *RawStream) Splitter() SplitterI {
+	rs.smu.RLock()
+	defer rs.smu.RUnlock()
+	return rs.splitter
 }
 
 func (rs *RawStream) Read(p []byte) (n int, err error) {
-	return rs.stream.Read(p)
+	return rs.getStream().Read(p)
 }
 
 func (rs *RawStream) Write(p []byte) (n int, err error) {
-	return rs.stream.Write(p)
+	return rs.getStream().Write(p)
 }
 
 func (rs *RawStream) Close() error {
-	return rs.stream.Close()
+	rs.smu.Lock()
+	rs.closed = true
+	rs.smu.Unlock()
+	return rs.getStream().Close()
+}
+
+func (rs *RawStream) CloseWithError(code quic.StreamErrorCode) {
+	rs.smu.Lock()
+	rs.closed = true
+	rs.smu.Unlock()
+	stream := rs.getStream()
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
 }
 
 func (rs *RawStream) StreamID() StreamID {
-	return StreamID(rs.stream.StreamID())
+	return StreamID(rs.getStream().StreamID())
 }
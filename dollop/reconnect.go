@@ -0,0 +1,199 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ErrReconnectFailed be reported if the client gave up after Backoff.MaxRetries attempts.
+var ErrReconnectFailed = errors.New("reconnect failed")
+
+type ClientState uint8
+
+const (
+	ClientStateConnecting ClientState = iota
+	ClientStateConnected
+	ClientStateReconnecting
+	ClientStateClosed
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientStateConnecting:
+		return "connecting"
+	case ClientStateConnected:
+		return "connected"
+	case ClientStateReconnecting:
+		return "reconnecting"
+	case ClientStateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ClientState(%d)", uint8(s))
+}
+
+// Backoff is the exponential backoff with jitter between reconnect attempts,
+// the zero or invalid fields fall back to those of DefaultBackoff.
+type Backoff struct {
+	Min        time.Duration // 第一次重连前的等待
+	Max        time.Duration // 等待的上限
+	Factor     float64       // 每次失败后等待时间的倍数
+	Jitter     float64       // 0~1, 等待时间随机浮动的比例, 避免客户端同时重连
+	MaxRetries int           // <=0 表示一直重连
+}
+
+var DefaultBackoff = Backoff{
+	Min:    time.Millisecond * 100,
+	Max:    time.Second * 10,
+	Factor: 2,
+	Jitter: 0.2,
+}
+
+// withDefaults fills the zero or invalid fields of b from DefaultBackoff.
+func (b Backoff) withDefaults() Backoff {
+	if b.Min <= 0 {
+		b.Min = DefaultBackoff.Min
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	if b.Max < b.Min {
+		b.Max = b.Min
+	}
+	if b.Factor < 1 {
+		b.Factor = DefaultBackoff.Factor
+	}
+	if b.Jitter < 0 {
+		b.Jitter = 0
+	} else if b.Jitter > 1 {
+		b.Jitter = 1
+	}
+	return b
+}
+
+// Duration returns the wait before the attempt-th (from 0) reconnect attempt.
+func (b Backoff) Duration(attempt int) time.Duration {
+	b = b.withDefaults()
+	d := float64(b.Min) * math.Pow(b.Factor, float64(attempt))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+// keepAlive waits for the conn to drop or the server to send GoAway, then reconnects.
+func (c *Client) keepAlive(addr string, cc *ClientConnection) {
+	for {
+		select {
+		case <-cc.Done():
+		case <-cc.GoingAway():
+			if c.isClosed() {
+				return
+			}
+			// server即将关闭该连接, 不等待超时直接重连
+			cc.qconn.CloseWithError(ClientConnectionCloseCode, "client reconnect")
+		}
+		if c.isClosed() {
+			return
+		}
+
+		c.setState(ClientStateReconnecting)
+		newConn, err := c.redial(addr)
+		if err != nil {
+			c.logger.Error("reconnect gave up", "addr", addr, "err", err)
+			c.markClosed()
+			return
+		}
+		cc = newConn
+	}
+}
+
+func (c *Client) redial(addr string) (*ClientConnection, error) {
+	backoff := *c.reconnect
+	for attempt := 0; backoff.MaxRetries <= 0 || attempt < backoff.MaxRetries; attempt++ {
+		// 等待期间client被关闭时立即放弃
+		timer := time.NewTimer(backoff.Duration(attempt))
+		select {
+		case <-timer.C:
+		case <-c.closedCh:
+			timer.Stop()
+			return nil, ErrReconnectFailed
+		}
+
+		cc, err := c.dial(context.Background(), addr)
+		if err != nil {
+			c.logger.Info("reconnect failed", "addr", addr, "attempt", attempt, "err", err)
+			continue
+		}
+		err = c.restoreSession(cc)
+		if err != nil {
+			cc.logger.Warn("restore session failed", "err", err)
+			cc.qconn.CloseWithError(ClientConnectionCloseCode, "client reconnect")
+			continue
+		}
+
+		c.setConn(cc)
+		c.setState(ClientStateConnected)
+		cc.logger.Info("reconnected", "attempt", attempt)
+		return cc, nil
+	}
+	return nil, ErrReconnectFailed
+}
+
+// restoreSession requests the streams the application had open on the new conn,
+// rebinds them into the old stream handles, and subscribes the topics again.
+func (c *Client) restoreSession(cc *ClientConnection) error {
+	// 应用已关闭的流不再恢复
+	c.mu.Lock()
+	rawStreams := make([]*RawStream, 0, len(c.rawStreams))
+	for _, rs := range c.rawStreams {
+		if !rs.isClosed() {
+			rawStreams = append(rawStreams, rs)
+		}
+	}
+	c.rawStreams = append([]*RawStream{}, rawStreams...)
+	frameStreams := make([]*FrameStream, 0, len(c.frameStreams))
+	for _, fs := range c.frameStreams {
+		if !fs.isClosed() {
+			frameStreams = append(frameStreams, fs)
+		}
+	}
+	c.frameStreams = append([]*FrameStream{}, frameStreams...)
+	subscriptions := make(map[string]FrameStreamI, len(c.subscriptions))
+	for topic, fs := range c.subscriptions {
+		subscriptions[topic] = fs
+	}
+	c.mu.Unlock()
+
+	for _, rs := range rawStreams {
+		newStream, id, err := cc.requestRawStream()
+		if err != nil {
+			return err
+		}
+		rs.rebind(newStream.getStream())
+		cc.addRawStream(id, rs)
+	}
+	for _, fs := range frameStreams {
+		newStream, id, err := cc.requestFrameStream(fs.requested...)
+		if err != nil {
+			return err
+		}
+		fs.BindMsgProtocol(newStream.GetMsgProtocol()) // 新server可能协商出其他版本
+		fs.setCompression(newStream.compressor, newStream.compressMin)
+		fs.rebind(newStream.getStream()) // 最后替换, 等待rebind的RPCStream醒来时流已就绪
+		cc.addFrameStream(id, fs)
+	}
+	for topic, fs := range subscriptions {
+		err := cc.Subscribe(topic, fs.StreamID())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
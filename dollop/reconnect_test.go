@@ -0,0 +1,145 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	b := Backoff{Min: 10 * time.Millisecond, Max: 40 * time.Millisecond, Factor: 2}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	for attempt, w := range want {
+		if d := b.Duration(attempt); d != w {
+			t.Errorf("Duration(%d) = %v, want %v", attempt, d, w)
+		}
+	}
+
+	b.Jitter = 0.5
+	for attempt := 0; attempt < 100; attempt++ {
+		if d := b.Duration(attempt); d < 5*time.Millisecond || d > 60*time.Millisecond {
+			t.Fatalf("Duration(%d) = %v with jitter, want within [5ms, 60ms]", attempt, d)
+		}
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	for _, b := range []Backoff{
+		{},
+		{Min: -time.Second, Max: -time.Second, Factor: 0.5},
+	} {
+		last := time.Duration(0)
+		for attempt := 0; attempt < 20; attempt++ {
+			d := b.Duration(attempt)
+			if d <= 0 || d < last*9/10 || d > DefaultBackoff.Max*12/10 {
+				t.Fatalf("%+v: Duration(%d) = %v after %v, want positive, not shrinking and capped", b, attempt, d, last)
+			}
+			last = d
+		}
+	}
+
+	// Max小于Min时以Min为上限, Jitter最多为1
+	b := Backoff{Min: time.Second, Max: time.Millisecond, Jitter: 3}
+	for attempt := 0; attempt < 100; attempt++ {
+		if d := b.Duration(attempt); d <= 0 || d > 2*time.Second {
+			t.Fatalf("%+v: Duration(%d) = %v, want within (0, 2s]", b, attempt, d)
+		}
+	}
+
+	c := NewClient("test", nil, nil)
+	c.EnableReconnect(Backoff{Factor: 0.1, Jitter: -1})
+	if got := *c.reconnect; got.Min != DefaultBackoff.Min || got.Max != DefaultBackoff.Max || got.Factor != DefaultBackoff.Factor || got.Jitter != 0 {
+		t.Fatalf("EnableReconnect kept %+v", got)
+	}
+}
+
+func TestRedialStopsOnClose(t *testing.T) {
+	c := NewClient("test", nil, nil)
+	c.EnableReconnect(Backoff{Min: time.Minute})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.redial("127.0.0.1:1")
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	if err := recvOrFail(t, errs); !errors.Is(err, ErrReconnectFailed) {
+		t.Fatalf("redial = %v, want ErrReconnectFailed", err)
+	}
+}
+
+func TestReconnectRestoresSession(t *testing.T) {
+	mp := newEchoProtocol(echoRouter{})
+	s, addr := startTestServer(t, WithMsgProtocol(mp))
+	states := make(chan ClientState, 16)
+	c := dialTestClient(t, addr, func(c *Client) {
+		c.EnableReconnect(Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond})
+		c.OnStateChange(func(state ClientState) { states <- state })
+	})
+	fs, _, err := c.NewFrameStream(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, _, err := c.NewRPCStream(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _, err := c.NewFrameStream(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe("news", sub); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []ClientState{ClientStateConnecting, ClientStateConnected} {
+		if got := recvOrFail(t, states); got != want {
+			t.Fatalf("state = %v, want %v", got, want)
+		}
+	}
+
+	// server发送GoAway, client重连到同一server
+	old := c.getConn()
+	s.ConnMgr.Range(func(conn ConnectionIS) bool {
+		conn.(*ServerConnection).GoAway("test")
+		return true
+	})
+	for _, want := range []ClientState{ClientStateReconnecting, ClientStateConnected} {
+		if got := recvOrFail(t, states); got != want {
+			t.Fatalf("state = %v, want %v", got, want)
+		}
+	}
+	if c.getConn() == old {
+		t.Fatal("client kept the old conn")
+	}
+
+	if err := fs.WriteMsg(NewBaseMsg([]byte("frame"))); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := fs.ReadMsg(); err != nil || string(m.GetData()) != "frame" {
+		t.Fatalf("restored frame stream read %v, %v", m, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if m, err := rs.Call(ctx, NewBaseMsg([]byte("call"))); err != nil || string(m.GetData()) != "call" {
+		t.Fatalf("restored rpc stream Call = %v, %v", m, err)
+	}
+
+	// 订阅在新连接上恢复
+	deadline := time.Now().Add(time.Second)
+	for s.Publish("news", NewBaseMsg([]byte("published"))) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription was not restored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m, err := sub.ReadMsg(); err != nil || string(m.GetData()) != "published" {
+		t.Fatalf("restored subscription read %v, %v", m, err)
+	}
+
+	c.Close()
+	if got := recvOrFail(t, states); got != ClientStateClosed {
+		t.Fatalf("state = %v, want %v", got, ClientStateClosed)
+	}
+}
@@ -1,10 +1,20 @@
 package dollop
 
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
 type RequestI interface {
 	GetConn() (ConnectionI, error)
 	GetData() ([]byte, error)
 }
 
+// RawRequestI carries the bytes of one read of a raw stream.
+// Its data is a pooled buffer which is reused once the routers and the ErrorHandler returned,
+// copy it if it is needed later, e.g. in another goroutine.
 type RawRequestI interface {
 	RequestI
 	GetStream() (RawStreamI, error)
@@ -13,9 +23,26 @@ type RawRequestI interface {
 // Request bind stream with data
 
 type RawRequest struct {
-	conn   ConnectionI
-	stream RawStreamI
-	data   []byte
+	conn     ConnectionI
+	stream   RawStreamI
+	data     []byte
+	buf      *[]byte         // data所在的池化buffer, 由release归还
+	inflight *sync.WaitGroup // 所在流上未结束的handler, 流结束后等其返回再关闭发送端
+}
+
+// release gives the buffer of data back to the pool.
+func (r *RawRequest) release() {
+	if r.buf != nil {
+		putBuf(r.buf)
+		r.buf, r.data = nil, nil
+	}
+}
+
+// finish marks the handler of r returned or r dropped.
+func (r *RawRequest) finish() {
+	if r.inflight != nil {
+		r.inflight.Done()
+	}
 }
 
 func (r RawRequest) GetConn() (ConnectionI, error) {
@@ -33,14 +60,41 @@ func (r RawRequest) GetData() ([]byte, error) {
 type FrameRequestI interface {
 	RequestI
 	GetStream() (FrameStreamI, error)
+	GetMsg() (MsgI, error)
+	// IsCall reports whether the msg is a rpc call sent by RPCStream.Call
+	IsCall() bool
+	// Reply writes m back on the same stream, as the reply of the call if IsCall.
+	// A call is replied with ErrNoReply if its handler returns without replying.
+	Reply(m MsgI) error
+	// ReplyError writes err back on the same stream, the peer gets a *RemoteError
+	ReplyError(err error) error
+	// Context carries the span of the router, a child of the span sent by the peer
+	Context() context.Context
+	// Body reads the body of a chunked msg sent by WriteMsgFrom, nil for other msgs.
+	// It is readable until the handler returns.
+	Body() io.Reader
 }
 
 // Request bind stream with data
 
 type FrameRequest struct {
-	conn   ConnectionI
-	stream FrameStreamI
-	msg    MsgI
+	conn     ConnectionI
+	stream   FrameStreamI
+	msg      MsgI
+	isCall   bool
+	callID   uint32
+	ctx      context.Context
+	body     io.Reader       // 分块msg的body
+	frame    *Frame          // msg所在的帧, 池化时在handler结束后归还
+	replied  int32           // 已回复call, 原子访问
+	inflight *sync.WaitGroup // 所在流上未结束的handler, 流结束后等其返回再关闭发送端
+}
+
+// finish marks the handler of r returned or r dropped.
+func (r *FrameRequest) finish() {
+	if r.inflight != nil {
+		r.inflight.Done()
+	}
 }
 
 func (r FrameRequest) GetConn() (ConnectionI, error) {
@@ -58,3 +112,80 @@ func (r FrameRequest) GetMsg() (MsgI, error) {
 func (r FrameRequest) GetData() ([]byte, error) {
 	return r.msg.GetData(), nil
 }
+
+func (r FrameRequest) IsCall() bool {
+	return r.isCall
+}
+
+func (r FrameRequest) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+func (r FrameRequest) Body() io.Reader {
+	return r.body
+}
+
+func (r *FrameRequest) Reply(m MsgI) error {
+	if !r.isCall {
+		return r.stream.WriteMsgCtx(r.Context(), m)
+	}
+	data, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&r.replied, 1)
+	f := newRPCFrame(FrameFlagReply, r.callID, data)
+	f.setTrace(SpanContextFromContext(r.Context()))
+	return r.stream.writeFrame(f)
+}
+
+func (r *FrameRequest) ReplyError(err error) error {
+	flags := FrameFlagError
+	if r.isCall {
+		flags |= FrameFlagReply
+		atomic.StoreInt32(&r.replied, 1)
+	}
+	f := newRPCFrame(flags, r.callID, []byte(err.Error()))
+	f.setTrace(SpanContextFromContext(r.Context()))
+	return r.stream.writeFrame(f)
+}
+
+// replyIfUnanswered replies err to a call which is not replied yet, so the caller does not wait forever.
+func (r *FrameRequest) replyIfUnanswered(err error) {
+	if r.isCall && atomic.LoadInt32(&r.replied) == 0 {
+		r.ReplyError(err)
+	}
+}
+
+type DatagramRequestI interface {
+	RequestI
+	GetChannel() (DatagramChannelI, error)
+	GetMsg() (MsgI, error)
+}
+
+// Request bind datagram channel with msg
+
+type DatagramRequest struct {
+	conn    ConnectionI
+	channel DatagramChannelI
+	msg     MsgI
+}
+
+func (r DatagramRequest) GetConn() (ConnectionI, error) {
+	return r.conn, nil
+}
+
+func (r DatagramRequest) GetChannel() (DatagramChannelI, error) {
+	return r.channel, nil
+}
+
+func (r DatagramRequest) GetMsg() (MsgI, error) {
+	return r.msg, nil
+}
+
+func (r DatagramRequest) GetData() ([]byte, error) {
+	return r.msg.GetData(), nil
+}
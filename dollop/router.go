@@ -1,13 +1,26 @@
 package dollop
 
-import "fmt"
-
 type RawRouterI interface {
 	PreHandler(req RawRequestI) error
 	Handler(req RawRequestI) error
 	AfterHandler(req RawRequestI) error
 }
 
+// DefaultRawReadSize is the read size of a raw stream if no router asks for one.
+const DefaultRawReadSize int = 512
+
+// RawReadSizerI is optionally implemented by a RawRouterI to choose how many bytes a raw stream reads at most
+// for one RawRequest, the largest size of the routers is used.
+type RawReadSizerI interface {
+	ReadSize() int
+}
+
+// RawSplitterI is optionally implemented by a RawRouterI to split the raw streams into records,
+// used for the streams without their own splitter, the first router implementing it wins.
+type RawSplitterI interface {
+	Splitter() SplitterI
+}
+
 // inherit this BaseRouter while implement a new Router
 type BaseRawRouter struct {
 }
@@ -17,7 +30,6 @@ func (br BaseRawRouter) PreHandler(req RawRequestI) error {
 }
 
 func (br BaseRawRouter) Handler(req RawRequestI) error {
-	fmt.Println("default raw router preHandler")
 	return nil
 }
 
@@ -40,10 +52,31 @@ func (br BaseFrameRouter) PreHandler(req FrameRequestI) error {
 }
 
 func (br BaseFrameRouter) Handler(req FrameRequestI) error {
-	fmt.Println("default frame router preHandler")
 	return nil
 }
 
 func (br BaseFrameRouter) AfterHandler(req FrameRequestI) error {
 	return nil
 }
+
+type DatagramRouterI interface {
+	PreHandler(req DatagramRequestI) error
+	Handler(req DatagramRequestI) error
+	AfterHandler(req DatagramRequestI) error
+}
+
+// inherit this BaseRouter while implement a new Router
+type BaseDatagramRouter struct {
+}
+
+func (br BaseDatagramRouter) PreHandler(req DatagramRequestI) error {
+	return nil
+}
+
+func (br BaseDatagramRouter) Handler(req DatagramRequestI) error {
+	return nil
+}
+
+func (br BaseDatagramRouter) AfterHandler(req DatagramRequestI) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+package dollop
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnknownTagRouting(t *testing.T) {
+	unknown := BaseMsgType(7)
+	encoded := BuildMsg(unknown, []byte("x"))
+	for _, withFallback := range []bool{true, false} {
+		mp := newEchoProtocol(echoRouter{})
+		if withFallback {
+			mp.SetFallbackRouter(echoRouter{})
+		}
+		m := NewMetrics()
+		_, addr := startTestServer(t, WithMsgProtocol(mp), WithMetrics(m))
+		c := dialTestClient(t, addr, nil)
+		fs, _, err := c.NewFrameStream(mp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fs.WriteMsg(NewUnknownMsg(unknown, encoded)); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := fs.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped := m.NewCounter("dollop_msgs_dropped_total", "").Value()
+		if withFallback {
+			// fallback router收到整个msg并原样回复
+			if reply.Type() != BaseMsgTag || !bytes.Equal(reply.GetData(), encoded) {
+				t.Fatalf("fallback reply = %v %q, want the echo of %q", reply.Type(), reply.GetData(), encoded)
+			}
+			if dropped != 0 {
+				t.Fatalf("dollop_msgs_dropped_total = %d with a fallback router, want 0", dropped)
+			}
+			continue
+		}
+		if _, ok := reply.(*NotFoundMsg); !ok || !bytes.Equal(reply.GetData(), []byte{byte(unknown)}) {
+			t.Fatalf("reply = %T %v, want a NotFoundMsg of tag %d", reply, reply.GetData(), unknown)
+		}
+		if dropped != 1 {
+			t.Fatalf("dollop_msgs_dropped_total = %d, want 1", dropped)
+		}
+	}
+}
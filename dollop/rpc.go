@@ -0,0 +1,189 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrRPCStreamClosed be returned by Call after the RPCStream is closed.
+	ErrRPCStreamClosed = errors.New("rpc stream closed")
+	// ErrNoReply is replied to a call whose handler returned without replying, Call gets it as a *RemoteError.
+	ErrNoReply = errors.New("handler returned without replying the call")
+)
+
+// RPCStream multiplexes concurrent calls on one FrameStream.
+// Every call frame carries a call id, the peer replies with the same id by FrameRequest.Reply.
+// RPCStream owns the reading side of the stream, frames that are not replies are dropped.
+type RPCStream struct {
+	stream  FrameStreamI
+	nextID  uint32
+	pending map[uint32]chan rpcReply
+	mu      sync.Mutex
+	done    chan struct{}
+	err     error
+	// 非nil时流可在client重连后恢复, client关闭时关闭
+	clientClosed <-chan struct{}
+}
+
+type rpcReply struct {
+	msg MsgI
+	err error // *RemoteError
+}
+
+// NewRPCStream wraps a FrameStream and starts reading replies from it.
+func NewRPCStream(stream FrameStreamI) *RPCStream {
+	return newRPCStream(stream, nil)
+}
+
+// newRPCStream wraps stream, which is restored by the client until clientClosed is closed if it is not nil.
+func newRPCStream(stream FrameStreamI, clientClosed <-chan struct{}) *RPCStream {
+	rs := &RPCStream{
+		stream:       stream,
+		pending:      make(map[uint32]chan rpcReply),
+		done:         make(chan struct{}),
+		clientClosed: clientClosed,
+	}
+	go rs.readLoop()
+	return rs
+}
+
+func (rs *RPCStream) StreamID() StreamID {
+	return rs.stream.StreamID()
+}
+
+// Call sends m and waits for the reply of the peer, until ctx is done or the stream is closed.
+// A *RemoteError is returned if the peer's handler replied an error.
+// The span of ctx is carried to the peer.
+func (rs *RPCStream) Call(ctx context.Context, m MsgI) (MsgI, error) {
+	id := atomic.AddUint32(&rs.nextID, 1)
+	replyChan := make(chan rpcReply, 1)
+
+	rs.mu.Lock()
+	if rs.err != nil {
+		rs.mu.Unlock()
+		return nil, rs.err
+	}
+	rs.pending[id] = replyChan
+	rs.mu.Unlock()
+
+	defer func() {
+		rs.mu.Lock()
+		delete(rs.pending, id)
+		rs.mu.Unlock()
+	}()
+
+	data, err := encodeMsg(m)
+	if err != nil {
+		return nil, err
+	}
+	f := newRPCFrame(FrameFlagCall, id, data)
+	f.setTrace(SpanContextFromContext(ctx))
+	err = rs.stream.writeFrame(f)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-replyChan:
+		return reply.msg, reply.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-rs.done:
+		return nil, rs.err
+	}
+}
+
+func (rs *RPCStream) readLoop() {
+	for {
+		rebound := rs.reboundChan()
+		f, err := rs.stream.readFrame()
+		if err != nil {
+			if rs.waitRestore(rebound, err) {
+				continue
+			}
+			rs.closeWithError(err)
+			return
+		}
+		if f.Flags()&FrameFlagReply == 0 {
+			continue
+		}
+
+		var reply rpcReply
+		if f.flags&FrameFlagError != 0 {
+			reply.err = &RemoteError{Msg: string(f.data)}
+		} else {
+			reply.msg, err = rs.stream.decodeMsg(f)
+			if errors.Is(err, ErrUnknownMsg) {
+				reply.err = err
+			} else if err != nil {
+				rs.closeWithError(err)
+				return
+			}
+		}
+
+		rs.mu.Lock()
+		replyChan, ok := rs.pending[f.callID]
+		rs.mu.Unlock()
+		if !ok {
+			// 超时的call已被移除, 迟到的回复直接丢弃
+			continue
+		}
+		select {
+		case replyChan <- reply:
+		default: // 重复的回复
+		}
+	}
+}
+
+// reboundChan returns the chan closed once the client restored the stream, nil if it is not restorable.
+func (rs *RPCStream) reboundChan() <-chan struct{} {
+	fs, ok := rs.stream.(*FrameStream)
+	if !ok || rs.clientClosed == nil {
+		return nil
+	}
+	return fs.reboundChan()
+}
+
+// waitRestore fails the pending calls with err and waits for the client to restore the stream,
+// it reports false if the stream is not restorable or the client or the stream was closed.
+func (rs *RPCStream) waitRestore(rebound <-chan struct{}, err error) bool {
+	if rebound == nil {
+		return false
+	}
+	// 旧连接上的call不会再收到回复
+	rs.mu.Lock()
+	for _, replyChan := range rs.pending {
+		select {
+		case replyChan <- rpcReply{err: err}:
+		default:
+		}
+	}
+	rs.mu.Unlock()
+
+	select {
+	case <-rebound:
+		return true
+	case <-rs.clientClosed:
+	case <-rs.done:
+	}
+	return false
+}
+
+func (rs *RPCStream) closeWithError(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.err != nil {
+		return
+	}
+	rs.err = err
+	close(rs.done)
+}
+
+// Close fails all pending calls and closes the underlying stream.
+func (rs *RPCStream) Close() {
+	rs.closeWithError(ErrRPCStreamClosed)
+	rs.stream.Close()
+}
@@ -0,0 +1,80 @@
+package dollop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRPCConcurrentCalls(t *testing.T) {
+	mp := newEchoProtocol(echoRouter{})
+	_, addr := startTestServer(t, WithMsgProtocol(mp))
+	c := dialTestClient(t, addr, nil)
+	rs, _, err := c.NewRPCStream(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			want := fmt.Sprintf("call %d", i)
+			m, err := rs.Call(ctx, NewBaseMsg([]byte(want)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if got := string(m.GetData()); got != want {
+				errs <- fmt.Errorf("reply = %q, want %q", got, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// failRouter fails the msgs "fail" and "panic", and returns without replying the others.
+type failRouter struct {
+	BaseFrameRouter
+}
+
+func (failRouter) Handler(req FrameRequestI) error {
+	m, _ := req.GetMsg()
+	switch string(m.GetData()) {
+	case "fail":
+		return errors.New("boom")
+	case "panic":
+		panic("boom")
+	}
+	return nil
+}
+
+func TestRPCCallUnanswered(t *testing.T) {
+	mp := newEchoProtocol(failRouter{})
+	_, addr := startTestServer(t, WithMsgProtocol(mp), WithErrorHandler(func(RequestI, error) {}))
+	c := dialTestClient(t, addr, nil)
+	rs, _, err := c.NewRPCStream(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"fail", "panic", "silent"} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := rs.Call(ctx, NewBaseMsg([]byte(data)))
+		cancel()
+		var re *RemoteError
+		if !errors.As(err, &re) {
+			t.Errorf("%s: Call err = %v, want a *RemoteError", data, err)
+		}
+	}
+}
@@ -11,9 +11,12 @@ import (
 	"crypto/tls"
 
 	"github.com/quic-go/quic-go"
-	// "golang.org/x/exp/slog"
+	"golang.org/x/exp/slog"
 )
 
+// ErrServerClosed be returned by Serve after Stop or Shutdown.
+var ErrServerClosed = errors.New("err server closed")
+
 // DefalutQuicConfig be used when `quicConfig` is nil.
 var DefalutQuicConfig = &quic.Config{
 	Versions:                       []quic.VersionNumber{quic.VersionDraft29, quic.Version1, quic.Version2},
@@ -53,9 +56,164 @@ func WithFrameRouter(r FrameRouterI) WithConfig {
 	}
 }
 
+// WithFrameMiddleware adds mws around the routers of all frame streams, before the middlewares of the msg protocol.
+// The control stream is not wrapped.
+func WithFrameMiddleware(mws ...FrameMiddleware) WithConfig {
+	return func(o *Server) {
+		o.FrameMiddlewares = append(o.FrameMiddlewares, mws...)
+	}
+}
+
+// WithRawMiddleware adds mws around the raw routers of all raw streams.
+func WithRawMiddleware(mws ...RawMiddleware) WithConfig {
+	return func(o *Server) {
+		o.RawMiddlewares = append(o.RawMiddlewares, mws...)
+	}
+}
+
+// WithErrorHandler sets the handler of the errors returned by routers and the panics recovered from them,
+// LogError by default. Use ReplyError or CloseStreamOnError to tell the peer,
+// the error of a call is always replied to the caller if the ErrorHandler did not.
+func WithErrorHandler(h ErrorHandler) WithConfig {
+	return func(o *Server) {
+		o.errorHandler = h
+	}
+}
+
+// WithDispatchMode sets how the handlers of stream and datagram msgs are executed, DispatchConcurrent by default.
+// DispatchPool uses a pool of DefaultPoolWorkers workers unless WithWorkerPool is given.
+func WithDispatchMode(mode DispatchMode) WithConfig {
+	return func(o *Server) {
+		o.dispatchMode = mode
+	}
+}
+
+// WithWorkerPool selects DispatchPool with workers sharing the handlers of all conns,
+// each worker queues at most queueSize msgs before the reading of the streams is blocked.
+func WithWorkerPool(workers, queueSize int) WithConfig {
+	return func(o *Server) {
+		o.dispatchMode = DispatchPool
+		o.poolWorkers = workers
+		o.poolQueueSize = queueSize
+	}
+}
+
+// WithRawSplitter splits the data of every raw stream into records by s, unless the stream has its own splitter.
+// A record may be as large as the max frame size.
+func WithRawSplitter(s SplitterI) WithConfig {
+	return func(o *Server) {
+		o.rawSplitter = s
+	}
+}
+
+// WithFrameBufferPool makes frame streams read frames into pooled buffers, which are reused
+// once the handler and the ErrorHandler returned. Handlers must copy the msg data they keep,
+// e.g. a msg published to a topic.
+func WithFrameBufferPool() WithConfig {
+	return func(o *Server) {
+		o.pooledFrames = true
+	}
+}
+
+// WithMsgProtocol registers mp for the frame streams a client asks by its Name and Version.
+// The default protocol is always registered and bound to the streams which ask for none.
+func WithMsgProtocol(mp MsgProtocolI) WithConfig {
+	return func(o *Server) {
+		o.msgProtocols = append(o.msgProtocols, mp)
+	}
+}
+
+// WithCompression accepts cs for the frame streams opened by clients which asked for one of them,
+// the first asked is chosen. Frames whose data is at least minSize are compressed, <=0 for DefaultCompressMinSize.
+// The streams are not compressed by default.
+func WithCompression(minSize int, cs ...CompressorI) WithConfig {
+	return func(o *Server) {
+		o.compressMinSize = minSize
+		o.compressors = cs
+	}
+}
+
+// WithMaxFrameSize limits the frame size a peer may announce on any frame stream, <=0 means unlimited.
+func WithMaxFrameSize(size int) WithConfig {
+	return func(o *Server) {
+		o.MaxFrameSize = size
+	}
+}
+
+// WithDatagrams enables quic datagrams, incoming datagrams are parsed by mp
+// and routed to the routers added by WithDatagramRouter.
+func WithDatagrams(mp MsgProtocolI) WithConfig {
+	return func(o *Server) {
+		o.DatagramProtocol = mp
+	}
+}
+
+// WithDatagramRouter routes the datagrams of tag to r, tag is converted by the TagEncoding of the
+// datagram protocol like AddM2R, NewServer returns an error if it can not be.
+func WithDatagramRouter(tag MsgType, r DatagramRouterI) WithConfig {
+	return func(o *Server) {
+		o.DatagramRouters[tag] = r
+	}
+}
+
+// WithTopicQueueSize sets the queue size of each topic subscriber.
+func WithTopicQueueSize(size int) WithConfig {
+	return func(o *Server) {
+		o.topicQueueSize = size
+	}
+}
+
+// WithSlowConsumerPolicy sets what to do when a subscriber's queue is full.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) WithConfig {
+	return func(o *Server) {
+		o.slowConsumerPolicy = p
+	}
+}
+
+// WithLogger sets the structured logger of the server and its conns, the server is silent by default.
+func WithLogger(l *slog.Logger) WithConfig {
+	return func(o *Server) {
+		o.logger = l
+	}
+}
+
+// WithMetrics records the metrics of the server and its conns into m,
+// serve m as an http.Handler to expose them in the prometheus text format.
+// The metric names are fixed, servers sharing m add up into the same metrics.
+func WithMetrics(m *Metrics) WithConfig {
+	return func(o *Server) {
+		o.Metrics = m
+	}
+}
+
+// WithTracer sets the tracer which starts a span for every frame request,
+// the server records no span by default but still passes the peer's trace context on.
+func WithTracer(t TracerI) WithConfig {
+	return func(o *Server) {
+		o.tracer = t
+	}
+}
+
+// WithOnConnect sets the hook called after a new conn is registered.
+func WithOnConnect(h ConnHook) WithConfig {
+	return func(o *Server) {
+		o.onConnect = h
+	}
+}
+
+// WithOnDisconnect sets the hook called after a conn is closed and removed from the registry.
+func WithOnDisconnect(h ConnHook) WithConfig {
+	return func(o *Server) {
+		o.onDisconnect = h
+	}
+}
+
 type FrameHandler func(c *context.Context) error
 type ConnectionHandler func(conn quic.Connection)
 
+// ConnHook is called on conn lifecycle events, e.g. to attach or clean up a session.
+type ConnHook func(conn ConnectionIS)
+
 // Server
 type Server struct {
 	// server name
@@ -68,33 +226,102 @@ type Server struct {
 	// startHandlers           []FrameHandler
 	// beforeHandlers          []FrameHandler
 	// afterHandlers           []FrameHandler
-	// connectionCloseHandlers []ConnectionHandler
+	onConnect    ConnHook
+	onDisconnect ConnHook
 
 	RawRouters   []RawRouterI
 	FrameRouters []FrameRouterI
-	Listener     quic.Listener
-	// logger     *slog.Logger
+	// 路由中间件, 前者在外层
+	FrameMiddlewares []FrameMiddleware
+	RawMiddlewares   []RawMiddleware
+	rawSplitter      SplitterI
+	pooledFrames     bool
+	msgProtocols     []MsgProtocolI
+	Protocols        *ProtocolRegistry // 新帧流可协商的协议
+	compressors      []CompressorI
+	compressMinSize  int
+	MaxFrameSize     int
+	Listener         quic.Listener
+
+	DatagramProtocol MsgProtocolI // 非nil时开启datagram
+	DatagramRouters  map[MsgType]DatagramRouterI
+	logger           *slog.Logger
+	Metrics          *Metrics // nil时不记录
+	metrics          *serverMetrics
+	tracer           TracerI
+	errorHandler     ErrorHandler
+	dispatchMode     DispatchMode
+	poolWorkers      int
+	poolQueueSize    int
+	pool             *WorkerPool
+
+	ConnMgr ConnManagerI // 存活的连接
+	Broker  *Broker      // topic发布订阅
+
+	topicQueueSize     int
+	slowConsumerPolicy SlowConsumerPolicy
 
 	mutex sync.Mutex
 }
 
 func NewServer(name string, opts ...WithConfig) (*Server, error) {
 	s := &Server{
-		Name:       name,
-		closed:     false,
-		TlsConfig:  nil,
-		QuicConfig: DefalutQuicConfig,
+		Name:         name,
+		closed:       false,
+		TlsConfig:    nil,
+		QuicConfig:   DefalutQuicConfig,
+		MaxFrameSize: DefaultMaxFrameSize,
+		ConnMgr:      NewConnManager(),
+		logger:       discardLogger,
+		tracer:       noopTracer{},
+		errorHandler: LogError,
+
+		DatagramRouters: make(map[MsgType]DatagramRouterI),
 	}
 
 	for _, configFunc := range opts {
 		configFunc(s)
 	}
 
+	s.Broker = NewBroker(s.topicQueueSize, s.slowConsumerPolicy)
+	s.metrics = newServerMetrics(s.Metrics)
+
+	if s.DatagramProtocol != nil {
+		// 按datagram协议的TagEncoding转换tag, 否则无类型的1不会匹配BaseMsgType(1)
+		enc := tagEncodingOfProtocol(s.DatagramProtocol)
+		routers := make(map[MsgType]DatagramRouterI, len(s.DatagramRouters))
+		for tag, r := range s.DatagramRouters {
+			t, err := enc.Tag(tag)
+			if err != nil {
+				return &Server{}, fmt.Errorf("datagram router: %w", err)
+			}
+			routers[t] = r
+		}
+		s.DatagramRouters = routers
+	}
+	if s.DatagramProtocol != nil && !s.QuicConfig.EnableDatagrams {
+		// 不修改共享的DefalutQuicConfig
+		s.QuicConfig = s.QuicConfig.Clone()
+		s.QuicConfig.EnableDatagrams = true
+	}
+
 	// The tls.Config must not be nil and must contain a certificate configuration.
 	if s.TlsConfig == nil {
 		return &Server{}, errors.New("the tls.Config must not be nil and must contain a certificate configuration")
 	}
 
+	s.Protocols = NewProtocolRegistry()
+	for _, mp := range append([]MsgProtocolI{defaultMsgProtocol}, s.msgProtocols...) {
+		err := s.Protocols.Register(mp)
+		if err != nil {
+			return &Server{}, err
+		}
+	}
+
+	if s.dispatchMode == DispatchPool {
+		s.pool = NewWorkerPool(s.poolWorkers, s.poolQueueSize)
+	}
+
 	return s, nil
 }
 
@@ -104,27 +331,52 @@ func (s *Server) Serve(ctx context.Context, addr string) error {
 	closed := s.closed
 	s.mutex.Unlock()
 	if closed {
-		return errors.New("err server closed")
+		return ErrServerClosed
 	}
 
 	listener, err := quic.ListenAddr(addr, s.TlsConfig, s.QuicConfig)
 	if err != nil {
-		fmt.Println("failed to listen on quic", err)
+		s.logger.Error("failed to listen on quic", "addr", addr, "err", err)
 		return err
 	}
+	s.mutex.Lock()
 	s.Listener = listener
+	s.mutex.Unlock()
 
-	fmt.Println(s.Name, "is up and running", "pid", os.Getpid())
+	s.logger.Info("server is up and running", "name", s.Name, "addr", addr, "pid", os.Getpid())
 
 	for {
-		qconn, err := s.Listener.Accept(ctx)
+		qconn, err := listener.Accept(ctx)
 		if err != nil {
-			fmt.Println(err)
+			if s.isClosed() || errors.Is(err, quic.ErrServerClosed) {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.logger.Warn("accept conn failed", "err", err)
 			continue
 		}
 
 		conn := NewServerConnection(ctx, qconn)
+		conn.SetLogger(s.logger)
+		conn.metrics = s.metrics
+		conn.SetTracer(s.tracer)
+		conn.logger.Debug("conn accepted")
+		conn.SetMaxFrameSize(s.MaxFrameSize)
+		conn.broker = s.Broker
+		conn.datagramProtocol = s.DatagramProtocol
+		conn.datagramRouters = s.DatagramRouters
 		conn.BindRawRouters(s.RawRouters) // 将服务器路由绑定到流路由
+		conn.frameMiddlewares = s.FrameMiddlewares
+		conn.rawMiddlewares = s.RawMiddlewares
+		conn.rawSplitter = s.rawSplitter
+		conn.pooledFrames = s.pooledFrames
+		conn.protocols = s.Protocols
+		conn.SetCompression(s.compressMinSize, s.compressors...)
+		conn.errorHandler = s.errorHandler
+		conn.dispatchMode = s.dispatchMode
+		conn.pool = s.pool
 		// 子流在启动后均会绑定defaultMsgProtocol, 由controlMsg协议的Router设定
 		// 后续子流的协议，可以开发时自行指定，BindMsgProtocol。
 
@@ -132,17 +384,139 @@ func (s *Server) Serve(ctx context.Context, addr string) error {
 
 			defer conn.Close()
 
+			done := conn.Serve(ctx)
+			select {
+			case <-done:
+				return // 控制流建立失败
+			default:
+			}
+
+			// 握手完成后才登记, ConnMgr中不会出现半开的连接
+			connected, ok := s.trackConn(conn)
+			if !ok {
+				// Shutdown 已经开始或连接已关闭, 不触发OnConnect
+				conn.closeWithError(ServerShutdownCloseCode, "server shutdown")
+				return
+			}
+			if s.onConnect != nil {
+				s.onConnect(conn)
+			}
+			close(connected)
+
 			select {
 			case <-ctx.Done():
 				return
-			case <-conn.Serve(ctx):
+			case <-done:
 			}
 		}(conn)
 
 	}
 }
 
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// trackConn registers a handshaked conn into ConnMgr, and removes it once the conn is closed.
+// It reports false if the server is shutting down or the conn is closed already,
+// otherwise the returned chan must be closed once OnConnect returned.
+func (s *Server) trackConn(conn *ServerConnection) (chan struct{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, false
+	}
+
+	connected := make(chan struct{})
+	onClose := func() {
+		conn.logger.Debug("conn closed")
+		s.ConnMgr.Remove(conn)
+		s.metrics.connsActive.Dec()
+		s.Broker.UnsubscribeAll(conn)
+		if s.onDisconnect == nil {
+			return
+		}
+		// OnDisconnect总在OnConnect返回之后调用, OnConnect中关闭连接时异步等待以免死锁
+		select {
+		case <-connected:
+			s.onDisconnect(conn)
+		default:
+			go func() {
+				<-connected
+				s.onDisconnect(conn)
+			}()
+		}
+	}
+
+	s.ConnMgr.Add(conn)
+	s.metrics.connsActive.Inc()
+	if !conn.setOnClose(onClose) {
+		s.ConnMgr.Remove(conn)
+		s.metrics.connsActive.Dec()
+		return nil, false
+	}
+	s.metrics.connsAccepted.Inc()
+	return connected, true
+}
+
+// Publish fans out m to all conns subscribed to topic, and returns how many got it.
+func (s *Server) Publish(topic string, m MsgI) int {
+	return s.Broker.Publish(topic, m)
+}
+
+// GetConnMgr returns the registry of live connections.
+func (s *Server) GetConnMgr() ConnManagerI {
+	return s.ConnMgr
+}
+
+// Stop closes the listener immediately, Serve returns ErrServerClosed.
+// quic-go closes the live connections with the listener, use Shutdown to drain them first.
 func (s *Server) Stop() error {
-	s.Listener.Close()
-	return nil
+	s.mutex.Lock()
+	s.closed = true
+	listener := s.Listener
+	s.mutex.Unlock()
+
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+// Shutdown stops accepting new connections, sends GoAway to every live connection,
+// waits for in-flight router handlers until ctx is done, and then closes all
+// connections with ServerShutdownCloseCode.
+// It returns ctx.Err() if the handlers did not finish in time.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true // 新连接由trackConn拒绝, listener在排空后才关闭, 关闭它会同时关闭所有连接
+	s.mutex.Unlock()
+
+	conns := make([]ConnectionIS, 0, s.ConnMgr.Len())
+	s.ConnMgr.Range(func(conn ConnectionIS) bool {
+		conns = append(conns, conn)
+		return true
+	})
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn ConnectionIS) {
+			errs <- conn.Shutdown(ctx)
+		}(conn)
+	}
+
+	var err error
+	for range conns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	s.Stop()
+	if s.pool != nil {
+		s.pool.Stop()
+	}
+	return err
 }
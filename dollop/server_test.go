@@ -0,0 +1,127 @@
+package dollop
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hookRecorder records the conn hooks of a server, in the order they were called.
+type hookRecorder struct {
+	connected    chan ConnectionIS
+	disconnected chan ConnectionIS
+	inConnect    int32 // OnConnect 正在执行
+	overlap      int32 // OnDisconnect 在 OnConnect 返回前被调用
+}
+
+func newHookRecorder() *hookRecorder {
+	return &hookRecorder{connected: make(chan ConnectionIS, 4), disconnected: make(chan ConnectionIS, 4)}
+}
+
+func (hr *hookRecorder) options(onConnect func(conn ConnectionIS)) []WithConfig {
+	return []WithConfig{
+		WithOnConnect(func(conn ConnectionIS) {
+			atomic.StoreInt32(&hr.inConnect, 1)
+			if onConnect != nil {
+				onConnect(conn)
+			}
+			time.Sleep(20 * time.Millisecond) // 留出OnDisconnect抢先的窗口
+			atomic.StoreInt32(&hr.inConnect, 0)
+			hr.connected <- conn
+		}),
+		WithOnDisconnect(func(conn ConnectionIS) {
+			if atomic.LoadInt32(&hr.inConnect) == 1 {
+				atomic.StoreInt32(&hr.overlap, 1)
+			}
+			hr.disconnected <- conn
+		}),
+	}
+}
+
+// expectNone fails if ch receives within a short while.
+func expectNone(t *testing.T, ch <-chan ConnectionIS) {
+	t.Helper()
+	select {
+	case conn := <-ch:
+		t.Fatalf("unexpected hook for conn %d", conn.ID())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConnMgrTracksHandshakedConns(t *testing.T) {
+	hr := newHookRecorder()
+	var registered int32
+	var s *Server
+	s, addr := startTestServer(t, hr.options(func(conn ConnectionIS) {
+		// OnConnect 调用时连接已登记
+		if _, err := s.ConnMgr.Get(conn.ID()); err == nil {
+			atomic.StoreInt32(&registered, 1)
+		}
+	})...)
+	c := dialTestClient(t, addr, nil)
+
+	conn := recvOrFail(t, hr.connected)
+	if atomic.LoadInt32(&registered) != 1 {
+		t.Fatal("conn is not in ConnMgr when OnConnect is called")
+	}
+	if n := s.ConnMgr.Len(); n != 1 {
+		t.Fatalf("ConnMgr.Len() = %d, want 1", n)
+	}
+
+	c.Close()
+	if got := recvOrFail(t, hr.disconnected); got.ID() != conn.ID() {
+		t.Fatalf("OnDisconnect got conn %d, want %d", got.ID(), conn.ID())
+	}
+	if _, err := s.ConnMgr.Get(conn.ID()); err == nil {
+		t.Fatal("closed conn is still in ConnMgr")
+	}
+	if n := s.ConnMgr.Len(); n != 0 {
+		t.Fatalf("ConnMgr.Len() = %d, want 0", n)
+	}
+	expectNone(t, hr.disconnected)
+}
+
+func TestOnDisconnectFollowsOnConnect(t *testing.T) {
+	hr := newHookRecorder()
+	s, addr := startTestServer(t, hr.options(func(conn ConnectionIS) {
+		conn.Close() // 在OnConnect中关闭连接
+	})...)
+	_, ct := testTLS(t)
+	c := NewClient("test", ct, DefalutQuicConfig)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c.Connect(ctx, addr) // 连接可能在client完成握手前就被关闭
+
+	conn := recvOrFail(t, hr.connected)
+	if got := recvOrFail(t, hr.disconnected); got.ID() != conn.ID() {
+		t.Fatalf("OnDisconnect got conn %d, want %d", got.ID(), conn.ID())
+	}
+	if atomic.LoadInt32(&hr.overlap) == 1 {
+		t.Fatal("OnDisconnect was called before OnConnect returned")
+	}
+	expectNone(t, hr.disconnected)
+	if n := s.ConnMgr.Len(); n != 0 {
+		t.Fatalf("ConnMgr.Len() = %d, want 0", n)
+	}
+}
+
+func TestTrackClosedConnSkipsHooks(t *testing.T) {
+	hr := newHookRecorder()
+	s, addr := startTestServer(t, hr.options(nil)...)
+	c := dialTestClient(t, addr, nil)
+
+	conn := recvOrFail(t, hr.connected)
+	c.Close()
+	recvOrFail(t, hr.disconnected)
+
+	// 已关闭的连接不会再被登记, 也不会触发任何hook
+	if _, ok := s.trackConn(conn.(*ServerConnection)); ok {
+		t.Fatal("trackConn accepted a closed conn")
+	}
+	if n := s.ConnMgr.Len(); n != 0 {
+		t.Fatalf("ConnMgr.Len() = %d, want 0", n)
+	}
+	expectNone(t, hr.disconnected)
+}
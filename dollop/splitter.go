@@ -0,0 +1,150 @@
+package dollop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/quic-go/quic-go"
+)
+
+// SplitErrorStreamCode resets a raw stream whose data can not be split into records, the peer sees it as a quic.StreamError.
+const SplitErrorStreamCode quic.StreamErrorCode = 0x02
+
+var (
+	// ErrBadVarint be returned by VarintLengthSplitter if the length prefix overflows.
+	ErrBadVarint = errors.New("bad varint length prefix")
+	// ErrBadHeader be returned by HeaderSplitter if the Content-Length header is invalid.
+	ErrBadHeader = errors.New("bad header")
+)
+
+// SplitterI splits the bytes of a raw stream into records, each record is handled by the raw routers
+// as one RawRequest. Split works like bufio.SplitFunc: it returns how many bytes to advance
+// and the record at the head of data, or a nil record to read more data.
+type SplitterI interface {
+	Split(data []byte, atEOF bool) (advance int, record []byte, err error)
+}
+
+// SplitFunc adapts a bufio.SplitFunc style function into a SplitterI.
+type SplitFunc func(data []byte, atEOF bool) (advance int, record []byte, err error)
+
+func (f SplitFunc) Split(data []byte, atEOF bool) (advance int, record []byte, err error) {
+	return f(data, atEOF)
+}
+
+// LineSplitter splits records by '\n', a trailing '\r' is dropped, the same as bufio.ScanLines.
+func LineSplitter() SplitterI {
+	return SplitFunc(bufio.ScanLines)
+}
+
+// DelimiterSplitter splits records by delim, the delim is not part of the record.
+// The data after the last delim is a record too. It panics if delim is empty.
+func DelimiterSplitter(delim []byte) SplitterI {
+	if len(delim) == 0 {
+		panic("dollop: DelimiterSplitter with an empty delim")
+	}
+	delim = append([]byte(nil), delim...)
+	return SplitFunc(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, delim); i >= 0 {
+			return i + len(delim), data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+}
+
+// VarintLengthSplitter splits records prefixed by their len as an uvarint, the prefix is not part of the record.
+func VarintLengthSplitter() SplitterI {
+	return SplitFunc(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		size, n := binary.Uvarint(data)
+		if n < 0 || size > uint64(^uint32(0)) {
+			return 0, nil, ErrBadVarint
+		}
+		if n == 0 || uint64(len(data)-n) < size {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		end := n + int(size)
+		return end, data[n:end], nil
+	})
+}
+
+// FixedSizeSplitter splits records of size bytes, a shorter tail at the end of the stream is an error.
+// It panics if size is not positive.
+func FixedSizeSplitter(size int) SplitterI {
+	if size <= 0 {
+		panic("dollop: FixedSizeSplitter with a non-positive size " + strconv.Itoa(size))
+	}
+	return SplitFunc(func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) >= size {
+			return size, data[:size], nil
+		}
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	})
+}
+
+var (
+	headerEnd     = []byte("\r\n\r\n")
+	contentLength = []byte("content-length:")
+)
+
+// HeaderSplitter splits HTTP style records: header lines ended by an empty line, "\r\n\r\n",
+// followed by a body of Content-Length bytes if the header has one. The record is the header and the body.
+func HeaderSplitter() SplitterI {
+	return SplitFunc(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		i := bytes.Index(data, headerEnd)
+		if i < 0 {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		end := i + len(headerEnd)
+		bodyLen, err := headerContentLength(data[:i])
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(data)-end < bodyLen {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		end += bodyLen
+		return end, data[:end], nil
+	})
+}
+
+// headerContentLength returns the value of the Content-Length line of header, 0 if there is none.
+func headerContentLength(header []byte) (int, error) {
+	for _, line := range bytes.Split(header, []byte("\r\n")) {
+		if len(line) < len(contentLength) || !bytes.EqualFold(line[:len(contentLength)], contentLength) {
+			continue
+		}
+		n, err := strconv.Atoi(string(bytes.TrimSpace(line[len(contentLength):])))
+		if err != nil || n < 0 {
+			return 0, ErrBadHeader
+		}
+		return n, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,152 @@
+package dollop
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// splitAll splits data read in pieces of at most 3 bytes, so the splitters see partial records.
+func splitAll(s SplitterI, data string) ([]string, error) {
+	scanner := bufio.NewScanner(&pieceReader{data: []byte(data)})
+	scanner.Split(s.Split)
+	var records []string
+	for scanner.Scan() {
+		records = append(records, scanner.Text())
+	}
+	return records, scanner.Err()
+}
+
+type pieceReader struct{ data []byte }
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSplitters(t *testing.T) {
+	tests := []struct {
+		name     string
+		splitter SplitterI
+		data     string
+		want     []string
+		err      error
+	}{
+		{"line", LineSplitter(), "a\r\nbc\n\nd", []string{"a", "bc", "", "d"}, nil},
+		{"delim", DelimiterSplitter([]byte("||")), "ab||c||||d", []string{"ab", "c", "", "d"}, nil},
+		{"delim empty", DelimiterSplitter([]byte(",")), "", nil, nil},
+		{"varint", VarintLengthSplitter(), "\x02ab\x00\x03cde", []string{"ab", "", "cde"}, nil},
+		{"varint short", VarintLengthSplitter(), "\x05ab", nil, io.ErrUnexpectedEOF},
+		{"varint overflow", VarintLengthSplitter(), "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01", nil, ErrBadVarint},
+		{"fixed", FixedSizeSplitter(2), "abcdef", []string{"ab", "cd", "ef"}, nil},
+		{"fixed tail", FixedSizeSplitter(4), "abcdef", []string{"abcd"}, io.ErrUnexpectedEOF},
+		{"header", HeaderSplitter(), "A: 1\r\n\r\nContent-Length: 3\r\n\r\nxyzB: 2\r\n\r\n",
+			[]string{"A: 1\r\n\r\n", "Content-Length: 3\r\n\r\nxyz", "B: 2\r\n\r\n"}, nil},
+		{"header short body", HeaderSplitter(), "content-length: 5\r\n\r\nab", nil, io.ErrUnexpectedEOF},
+		{"header bad len", HeaderSplitter(), "Content-Length: -1\r\n\r\n", nil, ErrBadHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitAll(tt.splitter, tt.data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitterBadArgs(t *testing.T) {
+	for name, f := range map[string]func(){
+		"fixed 0":     func() { FixedSizeSplitter(0) },
+		"fixed -1":    func() { FixedSizeSplitter(-1) },
+		"delim nil":   func() { DelimiterSplitter(nil) },
+		"delim empty": func() { DelimiterSplitter([]byte{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestDelimiterSplitterCopiesDelim(t *testing.T) {
+	delim := []byte(",")
+	s := DelimiterSplitter(delim)
+	delim[0] = ';'
+	got, _ := splitAll(s, "a,b")
+	if len(got) != 2 {
+		t.Errorf("records = %q, the splitter must not share delim", got)
+	}
+}
+
+// recordRouter sends each raw record to records, and splits by splitter if not nil.
+type recordRouter struct {
+	BaseRawRouter
+	splitter SplitterI
+	records  chan string
+}
+
+func (rr recordRouter) Splitter() SplitterI {
+	return rr.splitter
+}
+
+func (rr recordRouter) Handler(req RawRequestI) error {
+	data, _ := req.GetData()
+	rr.records <- string(data)
+	return nil
+}
+
+func TestRawStreamRouterSplitter(t *testing.T) {
+	rr := recordRouter{splitter: LineSplitter(), records: make(chan string, 10)}
+	_, addr := startTestServer(t, WithRawRouter(rr), WithDispatchMode(DispatchSerial))
+	c := dialTestClient(t, addr, nil)
+	rs, _, err := c.NewRawStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Write([]byte("one\ntw"))
+	rs.Write([]byte("o\nthree\n"))
+	for _, want := range []string{"one", "two", "three"} {
+		if got := recvOrFail(t, rr.records); got != want {
+			t.Errorf("record = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServerOpenedRawStreamSplitter(t *testing.T) {
+	rr := recordRouter{records: make(chan string, 10)}
+	conns := make(chan ConnectionIS, 1)
+	_, addr := startTestServer(t, WithRawRouter(rr), WithOnConnect(func(conn ConnectionIS) { conns <- conn }))
+	incoming := make(chan RawStreamI, 1)
+	dialTestClient(t, addr, func(c *Client) {
+		c.OnIncomingRawStream(func(stream RawStreamI) { incoming <- stream })
+	})
+	conn := recvOrFail(t, conns)
+	if _, _, err := conn.OpenNewRawStream(FixedSizeSplitter(3)); err != nil {
+		t.Fatal(err)
+	}
+	stream := recvOrFail(t, incoming)
+	stream.Write(bytes.Repeat([]byte("abc"), 3))
+	for i := 0; i < 3; i++ {
+		if got := recvOrFail(t, rr.records); got != "abc" {
+			t.Errorf("record = %q, want abc", got)
+		}
+	}
+}
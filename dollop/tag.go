@@ -0,0 +1,200 @@
+package dollop
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// TagEncoding declares how a msg protocol encodes the tag at the head of its msgs.
+// Each encoding has one Go type for its tags, which the msgs return by Type and GetRouter looks up:
+//
+//	TagUint8  : BaseMsgType, 1 byte
+//	TagUint16 : uint16, 2 bytes big endian
+//	TagVarint : uint64, uvarint
+//	TagString : string, | len uvarint | route name |, e.g. "player.move"
+type TagEncoding uint8
+
+const (
+	TagUint8 TagEncoding = iota
+	TagUint16
+	TagVarint
+	TagString
+)
+
+// MaxStringTagLen is the max len of a route name of TagString.
+const MaxStringTagLen int = 255
+
+// TagEncodingI is optionally implemented by a MsgProtocolI to declare its tag encoding, TagUint8 otherwise.
+type TagEncodingI interface {
+	TagEncoding() TagEncoding
+}
+
+func (e TagEncoding) String() string {
+	switch e {
+	case TagUint8:
+		return "uint8"
+	case TagUint16:
+		return "uint16"
+	case TagVarint:
+		return "varint"
+	case TagString:
+		return "string"
+	}
+	return fmt.Sprintf("TagEncoding(%d)", uint8(e))
+}
+
+// Tag validates tag, any integer type in range or a string type according to e,
+// and converts it into the tag type of e. It is used at registration time.
+func (e TagEncoding) Tag(tag MsgType) (MsgType, error) {
+	v := reflect.ValueOf(tag)
+	if e == TagString {
+		if !v.IsValid() || v.Kind() != reflect.String {
+			return nil, fmt.Errorf("%w: %T is not a string tag", ErrBadMsgTag, tag)
+		}
+		s := v.String()
+		if len(s) == 0 || len(s) > MaxStringTagLen {
+			return nil, fmt.Errorf("%w: route name len %d not in [1, %d]", ErrBadMsgTag, len(s), MaxStringTagLen)
+		}
+		return s, nil
+	}
+
+	var n uint64
+	switch {
+	case !v.IsValid():
+		return nil, fmt.Errorf("%w: nil tag", ErrBadMsgTag)
+	case v.CanUint():
+		n = v.Uint()
+	case v.CanInt() && v.Int() >= 0:
+		n = uint64(v.Int())
+	default:
+		return nil, fmt.Errorf("%w: %v (%T) is not a %s tag", ErrBadMsgTag, tag, tag, e)
+	}
+	switch e {
+	case TagUint8:
+		if n <= math.MaxUint8 {
+			return BaseMsgType(n), nil
+		}
+	case TagUint16:
+		if n <= math.MaxUint16 {
+			return uint16(n), nil
+		}
+	case TagVarint:
+		return n, nil
+	}
+	return nil, fmt.Errorf("%w: %d overflows %s", ErrBadMsgTag, n, e)
+}
+
+// NotFoundTag is the tag reserved for NotFoundMsg by e.
+func (e TagEncoding) NotFoundTag() MsgType {
+	switch e {
+	case TagUint16:
+		return uint16(math.MaxUint16)
+	case TagVarint:
+		return uint64(math.MaxUint64)
+	case TagString:
+		return "dollop.notfound"
+	}
+	return NotFoundMsgTag
+}
+
+// AppendTag appends tag, of the tag type of e, to dst.
+func (e TagEncoding) AppendTag(dst []byte, tag MsgType) ([]byte, error) {
+	switch t := tag.(type) {
+	case BaseMsgType:
+		if e == TagUint8 {
+			return append(dst, byte(t)), nil
+		}
+	case uint16:
+		if e == TagUint16 {
+			return binary.BigEndian.AppendUint16(dst, t), nil
+		}
+	case uint64:
+		if e == TagVarint {
+			return binary.AppendUvarint(dst, t), nil
+		}
+	case string:
+		if e == TagString && len(t) > 0 && len(t) <= MaxStringTagLen {
+			dst = binary.AppendUvarint(dst, uint64(len(t)))
+			return append(dst, t...), nil
+		}
+	}
+	return dst, fmt.Errorf("%w: %v (%T) is not a %s tag", ErrBadMsgTag, tag, tag, e)
+}
+
+// ReadTag reads the tag at the head of data, n is its byte len.
+func (e TagEncoding) ReadTag(data []byte) (tag MsgType, n int, err error) {
+	switch e {
+	case TagUint8:
+		if len(data) >= 1 {
+			return BaseMsgType(data[0]), 1, nil
+		}
+	case TagUint16:
+		if len(data) >= 2 {
+			return binary.BigEndian.Uint16(data), 2, nil
+		}
+	case TagVarint:
+		v, n := binary.Uvarint(data)
+		if n > 0 {
+			return v, n, nil
+		}
+	case TagString:
+		size, n := binary.Uvarint(data)
+		if n > 0 && size > 0 && size <= uint64(MaxStringTagLen) && uint64(len(data)-n) >= size {
+			end := n + int(size)
+			return string(data[n:end]), end, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: short or malformed %s tag", ErrBadMsgTag, e)
+}
+
+// tagEncodingOf resolves the TagEncoding of tag by its kind, see BuildMsg.
+func tagEncodingOf(tag MsgType) (TagEncoding, error) {
+	v := reflect.ValueOf(tag)
+	switch {
+	case !v.IsValid():
+		return 0, fmt.Errorf("%w: nil tag", ErrBadMsgTag)
+	case v.Kind() == reflect.Uint8:
+		return TagUint8, nil
+	case v.Kind() == reflect.Uint16:
+		return TagUint16, nil
+	case v.CanUint(), v.CanInt():
+		return TagVarint, nil
+	case v.Kind() == reflect.String:
+		return TagString, nil
+	}
+	return 0, fmt.Errorf("%w: %T is neither an integer nor a string", ErrBadMsgTag, tag)
+}
+
+// CheckMsgTag returns an error wrapping ErrBadMsgTag if BuildMsg can not encode tag,
+// a custom MsgProtocolI calls it in AddM2R to reject the tag at registration instead of at write time.
+func CheckMsgTag(tag MsgType) error {
+	enc, err := tagEncodingOf(tag)
+	if err != nil {
+		return err
+	}
+	_, err = enc.Tag(tag)
+	return err
+}
+
+// tagLen returns the max byte len of tag encoded.
+func tagLen(tag MsgType) int {
+	switch t := tag.(type) {
+	case uint16:
+		return 2
+	case uint64:
+		return binary.MaxVarintLen64
+	case string:
+		return binary.MaxVarintLen64 + len(t)
+	}
+	return 1
+}
+
+// tagEncodingOfProtocol returns the TagEncoding declared by mp.
+func tagEncodingOfProtocol(mp MsgProtocolI) TagEncoding {
+	if te, ok := mp.(TagEncodingI); ok {
+		return te.TagEncoding()
+	}
+	return TagUint8
+}
@@ -0,0 +1,174 @@
+package dollop
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+type myUint8Tag uint8
+type myUint16Tag uint16
+type myIntTag int32
+type myRouteTag string
+
+func TestTagEncodingTag(t *testing.T) {
+	tests := []struct {
+		enc  TagEncoding
+		tag  MsgType
+		want MsgType
+		err  bool
+	}{
+		{TagUint8, 1, BaseMsgType(1), false},
+		{TagUint8, myUint8Tag(7), BaseMsgType(7), false},
+		{TagUint8, 300, nil, true},
+		{TagUint8, -1, nil, true},
+		{TagUint8, "a", nil, true},
+		{TagUint16, 300, uint16(300), false},
+		{TagUint16, myUint16Tag(40000), uint16(40000), false},
+		{TagUint16, 70000, nil, true},
+		{TagVarint, uint64(1 << 40), uint64(1 << 40), false},
+		{TagVarint, myIntTag(5), uint64(5), false},
+		{TagVarint, 1.5, nil, true},
+		{TagString, "player.move", "player.move", false},
+		{TagString, myRouteTag("chat"), "chat", false},
+		{TagString, "", nil, true},
+		{TagString, string(make([]byte, MaxStringTagLen+1)), nil, true},
+		{TagString, 1, nil, true},
+		{TagUint8, nil, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.enc.Tag(tt.tag)
+		if tt.err {
+			if !errors.Is(err, ErrBadMsgTag) {
+				t.Errorf("%s.Tag(%v) err = %v, want ErrBadMsgTag", tt.enc, tt.tag, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s.Tag(%v) = %v (%T), %v, want %v (%T)", tt.enc, tt.tag, got, got, err, tt.want, tt.want)
+		}
+	}
+}
+
+func TestTagRoundTrip(t *testing.T) {
+	tests := []struct {
+		enc TagEncoding
+		tag MsgType
+		len int
+	}{
+		{TagUint8, BaseMsgType(0x42), 1},
+		{TagUint16, uint16(0x1234), 2},
+		{TagVarint, uint64(300), 2},
+		{TagVarint, uint64(math.MaxUint64), 10},
+		{TagString, "player.move", 12},
+	}
+	for _, tt := range tests {
+		data, err := tt.enc.AppendTag(nil, tt.tag)
+		if err != nil {
+			t.Fatalf("%s.AppendTag(%v): %v", tt.enc, tt.tag, err)
+		}
+		if len(data) != tt.len {
+			t.Errorf("%s tag %v len = %d, want %d", tt.enc, tt.tag, len(data), tt.len)
+		}
+		got, n, err := tt.enc.ReadTag(append(data, 'x'))
+		if err != nil || got != tt.tag || n != tt.len {
+			t.Errorf("%s.ReadTag = %v, %d, %v, want %v, %d", tt.enc, got, n, err, tt.tag, tt.len)
+		}
+		if _, _, err := tt.enc.ReadTag(data[:len(data)-1]); err == nil {
+			t.Errorf("%s.ReadTag of a short tag succeeded", tt.enc)
+		}
+	}
+	if _, err := TagUint16.AppendTag(nil, BaseMsgType(1)); !errors.Is(err, ErrBadMsgTag) {
+		t.Errorf("AppendTag of another tag type err = %v", err)
+	}
+}
+
+func TestBuildMsg(t *testing.T) {
+	tests := []struct {
+		tag  MsgType
+		want []byte
+	}{
+		{BaseMsgTag, []byte{0x01, 'd'}},
+		{ControlMsgType(2), []byte{0x02, 'd'}},
+		{myUint8Tag(3), []byte{0x03, 'd'}},
+		{myUint16Tag(0x0102), []byte{0x01, 0x02, 'd'}},
+		{myIntTag(300), []byte{0xac, 0x02, 'd'}},
+		{uint32(1), []byte{0x01, 'd'}},
+		{myRouteTag("ab"), []byte{0x02, 'a', 'b', 'd'}},
+	}
+	for _, tt := range tests {
+		if got := BuildMsg(tt.tag, []byte("d")); !bytes.Equal(got, tt.want) {
+			t.Errorf("BuildMsg(%v (%T)) = % x, want % x", tt.tag, tt.tag, got, tt.want)
+		}
+	}
+	for _, tag := range []MsgType{myIntTag(-1), 1.5, struct{}{}, "", nil} {
+		if got := BuildMsg(tag, []byte("d")); got != nil {
+			t.Errorf("BuildMsg(%v (%T)) = % x, want nil", tag, tag, got)
+		}
+		if err := CheckMsgTag(tag); !errors.Is(err, ErrBadMsgTag) {
+			t.Errorf("CheckMsgTag(%v (%T)) = %v, want ErrBadMsgTag", tag, tag, err)
+		}
+	}
+	if _, err := encodeMsg(NewUnknownMsg(1.5, nil)); !errors.Is(err, ErrBadMsgTag) {
+		t.Errorf("encodeMsg of an unencodable msg err = %v", err)
+	}
+}
+
+func TestBaseMsgProtocolNamedTag(t *testing.T) {
+	bmp := NewBaseMsgProtocol("t", "v1")
+	if err := bmp.AddM2R(myUint8Tag(5), BaseFrameRouter{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bmp.GetRouter(BaseMsgType(5)); err != nil {
+		t.Errorf("GetRouter(5) = %v", err)
+	}
+	if _, err := bmp.GetRouter(myUint8Tag(5)); err != nil {
+		t.Errorf("GetRouter(myUint8Tag(5)) = %v", err)
+	}
+	if err := bmp.AddM2R(256, BaseFrameRouter{}); !errors.Is(err, ErrBadMsgTag) {
+		t.Errorf("AddM2R(256) = %v, want ErrBadMsgTag", err)
+	}
+}
+
+func TestCodecProtocolTags(t *testing.T) {
+	type move struct{ X, Y int }
+	for _, tt := range []struct {
+		enc TagEncoding
+		tag MsgType
+	}{
+		{TagUint8, 9},
+		{TagUint16, 40000},
+		{TagVarint, 1 << 40},
+		{TagString, "player.move"},
+	} {
+		cp, err := NewCodecProtocolWithTags("t", "v1", JSONCodec{}, tt.enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterType[move](cp, tt.tag); err != nil {
+			t.Fatalf("%s: %v", tt.enc, err)
+		}
+		if err := cp.Register(cp.TagEncoding().NotFoundTag(), &struct{ A int }{}); !errors.Is(err, ErrTagRegistered) {
+			t.Errorf("%s: registering the NotFound tag = %v", tt.enc, err)
+		}
+		m, err := cp.NewMsg(&move{X: 1, Y: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := cp.PaserMsg(NewFrame(m.Encode()))
+		v, err := MsgValue[move](got)
+		if err != nil || *v != (move{X: 1, Y: 2}) || got.Type() != m.Type() {
+			t.Errorf("%s: round trip = %v %v %v", tt.enc, got.Type(), v, err)
+		}
+
+		nf := cp.NotFoundMsg(got)
+		parsed := cp.PaserMsg(NewFrame(nf.Encode()))
+		if _, ok := parsed.(*NotFoundMsg); !ok || parsed.Type() != tt.enc.NotFoundTag() {
+			t.Errorf("%s: NotFound msg parsed as %T %v", tt.enc, parsed, parsed.Type())
+		}
+	}
+	if _, err := NewCodecProtocolWithTags("t", "v1", JSONCodec{}, TagString+1); !errors.Is(err, ErrBadMsgTag) {
+		t.Errorf("unknown encoding err = %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package dollop
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+type SpanID [8]byte
+
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+type TraceFlags uint8
+
+const TraceFlagsSampled TraceFlags = 1 << 0
+
+// SpanContext identifies a span across processes, it is carried in the frame metadata.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	TraceFlags TraceFlags
+	Remote     bool // 从对端的帧中解析得到
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.TraceFlags&TraceFlagsSampled != 0
+}
+
+type SpanI interface {
+	SpanContext() SpanContext
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// TracerI starts spans, the new span is a child of the span in ctx, or of the remote span carried by the frame.
+type TracerI interface {
+	Start(ctx context.Context, name string) (context.Context, SpanI)
+}
+
+// SpanData is a finished span handed to the SpanExporterI.
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	Parent      SpanContext // 无父span时无效
+	Start       time.Time
+	End         time.Time
+	Attributes  map[string]interface{}
+	Err         error
+}
+
+// SpanExporterI receives the finished sampled spans, e.g. to send them to a collector.
+type SpanExporterI interface {
+	ExportSpan(data SpanData)
+}
+
+type spanKey struct{}
+type remoteSpanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span, frames written with this ctx carry its SpanContext.
+func ContextWithSpan(ctx context.Context, span SpanI) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span of ctx, a no-op span if there is none.
+func SpanFromContext(ctx context.Context) SpanI {
+	if span, ok := ctx.Value(spanKey{}).(SpanI); ok {
+		return span
+	}
+	return noopSpan{sc: SpanContextFromContext(ctx)}
+}
+
+// ContextWithRemoteSpanContext returns a copy of ctx carrying the SpanContext received from the peer.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteSpanKey{}, sc)
+}
+
+// SpanContextFromContext returns the SpanContext of the current span of ctx,
+// or the remote SpanContext if ctx has no span.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	if span, ok := ctx.Value(spanKey{}).(SpanI); ok {
+		return span.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteSpanKey{}).(SpanContext)
+	return sc
+}
+
+// noopTracer is the default tracer, it records nothing but still passes the remote SpanContext on.
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, SpanI) {
+	return ctx, noopSpan{sc: SpanContextFromContext(ctx)}
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) SpanContext() SpanContext                 { return s.sc }
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// NewTracer creates a tracer that records every span and hands the sampled ones to exporter when they end.
+func NewTracer(exporter SpanExporterI) TracerI {
+	return &tracer{exporter: exporter}
+}
+
+type tracer struct {
+	exporter SpanExporterI
+}
+
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, SpanI) {
+	parent := SpanContextFromContext(ctx)
+	s := &span{tracer: t, data: SpanData{Name: name, Parent: parent, Start: time.Now()}}
+	if parent.IsValid() {
+		s.data.SpanContext.TraceID = parent.TraceID
+		s.data.SpanContext.TraceFlags = parent.TraceFlags
+	} else {
+		rand.Read(s.data.SpanContext.TraceID[:])
+		s.data.SpanContext.TraceFlags = TraceFlagsSampled
+	}
+	rand.Read(s.data.SpanContext.SpanID[:])
+	return ContextWithSpan(ctx, s), s
+}
+
+type span struct {
+	tracer *tracer
+	data   SpanData
+	ended  bool
+	mu     sync.Mutex
+}
+
+func (s *span) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *span) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err
+}
+
+// End finishes the span, only the first call takes effect.
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if s.tracer.exporter != nil && data.SpanContext.IsSampled() {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
@@ -0,0 +1,94 @@
+package dollop
+
+import (
+	"context"
+	"testing"
+)
+
+// chanExporter passes the finished spans to spans.
+type chanExporter struct {
+	spans chan SpanData
+}
+
+func (e chanExporter) ExportSpan(data SpanData) {
+	e.spans <- data
+}
+
+// streamSpan returns the next span of the requests of stream, skipping those of the control stream.
+func (e chanExporter) streamSpan(t *testing.T, stream StreamID) SpanData {
+	for {
+		span := recvOrFail(t, e.spans)
+		if span.Attributes[LogKeyStreamID] == int64(stream) {
+			return span
+		}
+	}
+}
+
+// traceRouter pushes a msg by WriteMsgCtx with the ctx of the request, then replies.
+type traceRouter struct {
+	BaseFrameRouter
+}
+
+func (tr traceRouter) Handler(req FrameRequestI) error {
+	stream, err := req.GetStream()
+	if err != nil {
+		return err
+	}
+	err = stream.WriteMsgCtx(req.Context(), NewBaseMsg([]byte("pushed")))
+	if err != nil {
+		return err
+	}
+	return req.Reply(NewBaseMsg([]byte("reply")))
+}
+
+func TestTraceAcrossFrames(t *testing.T) {
+	exporter := chanExporter{spans: make(chan SpanData, 8)}
+	mp := newEchoProtocol(traceRouter{})
+	_, addr := startTestServer(t, WithMsgProtocol(mp), WithTracer(NewTracer(exporter)), WithDispatchMode(DispatchSerial))
+	c := dialTestClient(t, addr, nil)
+	fs, _, err := c.NewFrameStream(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := SpanContext{TraceID: TraceID{1, 2, 3}, SpanID: SpanID{4, 5, 6}, TraceFlags: TraceFlagsSampled}
+	ctx := ContextWithRemoteSpanContext(context.Background(), remote)
+	if err := fs.WriteMsgCtx(ctx, NewBaseMsg([]byte("traced"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// handler的span是client span的子span
+	span := exporter.streamSpan(t, fs.StreamID())
+	remote.Remote = true
+	if span.Name != "dollop.frame" || span.Parent != remote {
+		t.Fatalf("handler span %q has parent %+v, want %+v", span.Name, span.Parent, remote)
+	}
+	if span.SpanContext.TraceID != remote.TraceID || span.SpanContext.SpanID == remote.SpanID || !span.SpanContext.SpanID.IsValid() {
+		t.Fatalf("handler span %+v is not a new span of trace %v", span.SpanContext, remote.TraceID)
+	}
+
+	// WriteMsgCtx和Reply写出的帧都携带handler span的上下文, 解析出的上下文标记为对端的
+	want := span.SpanContext
+	want.Remote = true
+	for _, data := range []string{"pushed", "reply"} {
+		f, err := fs.(*FrameStream).readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(f.GetData()[1:]) != data {
+			t.Fatalf("read %q, want %q", f.GetData()[1:], data)
+		}
+		sc, ok := f.SpanContext()
+		if !ok || sc != want {
+			t.Fatalf("frame carries %+v, %v, want the handler span %+v", sc, ok, want)
+		}
+	}
+
+	// 未携带trace的帧开始一个新的trace
+	if err := fs.WriteMsg(NewBaseMsg([]byte("untraced"))); err != nil {
+		t.Fatal(err)
+	}
+	if span := exporter.streamSpan(t, fs.StreamID()); span.Parent.IsValid() || span.SpanContext.TraceID == remote.TraceID {
+		t.Fatalf("span of an untraced frame %+v has parent %+v", span.SpanContext, span.Parent)
+	}
+}
@@ -2,7 +2,11 @@ module github.com/derekwin/dollop-net
 
 go 1.19
 
-require github.com/quic-go/quic-go v0.34.0
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/quic-go/quic-go v0.34.0
+	golang.org/x/exp v0.0.0-20230420155640-133eef4313cb
+)
 
 require (
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
@@ -12,7 +16,6 @@ require (
 	github.com/quic-go/qtls-go1-19 v0.3.2 // indirect
 	github.com/quic-go/qtls-go1-20 v0.2.2 // indirect
 	golang.org/x/crypto v0.4.0 // indirect
-	golang.org/x/exp v0.0.0-20230420155640-133eef4313cb // indirect
 	golang.org/x/mod v0.6.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect